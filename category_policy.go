@@ -0,0 +1,113 @@
+package id_generator
+
+import (
+	"errors"
+	"time"
+)
+
+// CategoryPolicy controls how a category leases IDs from the IDProvider.
+type CategoryPolicy struct {
+	// BatchSize is the number of IDs leased from the provider in a single round-trip.
+	// In adaptive mode it is the initial size and defaults to MinBatchSize.
+	BatchSize uint64
+	// Adaptive enables growing and shrinking the batch size based on how
+	// quickly the previous batch was drained.
+	Adaptive bool
+	// MinBatchSize and MaxBatchSize bound the batch size in adaptive mode.
+	MinBatchSize uint64
+	MaxBatchSize uint64
+	// TargetInterval is the desired time between two provider round-trips in adaptive mode.
+	TargetInterval time.Duration
+	// LowWatermark is the number of remaining IDs at which the next batch is
+	// leased in the background. Zero disables prefetching.
+	LowWatermark uint64
+}
+
+func (p CategoryPolicy) validate() error {
+	if !p.Adaptive {
+		if p.BatchSize == 0 {
+			return errors.New("batch size must be greater than 0")
+		}
+		if p.LowWatermark >= p.BatchSize {
+			return errors.New("low watermark must be less than batch size")
+		}
+		return nil
+	}
+	if p.MinBatchSize == 0 {
+		return errors.New("min batch size must be greater than 0")
+	}
+	if p.MaxBatchSize < p.MinBatchSize {
+		return errors.New("max batch size must not be less than min batch size")
+	}
+	if p.TargetInterval <= 0 {
+		return errors.New("target interval must be greater than 0")
+	}
+	if p.LowWatermark >= p.MinBatchSize {
+		return errors.New("low watermark must be less than min batch size")
+	}
+	return nil
+}
+
+func (p CategoryPolicy) initialBatchSize() uint64 {
+	if !p.Adaptive {
+		return p.BatchSize
+	}
+	return p.clamp(p.BatchSize)
+}
+
+// adjust returns the batch size for the next lease given the current size
+// and the time it took to drain the previous batch. The size changes by at
+// most a factor of 2 per lease.
+func (p CategoryPolicy) adjust(current uint64, elapsed time.Duration) uint64 {
+	if !p.Adaptive {
+		return current
+	}
+	if elapsed <= 0 {
+		elapsed = time.Nanosecond
+	}
+	next := float64(current) * float64(p.TargetInterval) / float64(elapsed)
+	if max := float64(current) * 2; next > max {
+		next = max
+	}
+	if min := float64(current) / 2; next < min {
+		next = min
+	}
+	return p.clamp(uint64(next))
+}
+
+func (p CategoryPolicy) clamp(size uint64) uint64 {
+	if size < p.MinBatchSize {
+		return p.MinBatchSize
+	}
+	if size > p.MaxBatchSize {
+		return p.MaxBatchSize
+	}
+	return size
+}
+
+type categoryState struct {
+	policy    CategoryPolicy
+	batchSize uint64
+	leasedAt  time.Time
+}
+
+func newCategoryState(policy CategoryPolicy) *categoryState {
+	return &categoryState{
+		policy:    policy,
+		batchSize: policy.initialBatchSize(),
+	}
+}
+
+// nextBatchSize returns the batch size to lease at the given time.
+func (c *categoryState) nextBatchSize(now time.Time) uint64 {
+	if c.leasedAt.IsZero() {
+		return c.batchSize
+	}
+	return c.policy.adjust(c.batchSize, now.Sub(c.leasedAt))
+}
+
+// leased records a successful lease of the given size.
+func (c *categoryState) leased(size uint64, now time.Time) {
+	c.batchSize = size
+	c.leasedAt = now
+}
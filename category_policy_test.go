@@ -0,0 +1,137 @@
+package id_generator
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_categoryPolicy_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  CategoryPolicy
+		wantErr bool
+	}{
+		{
+			name:   "FIXED",
+			policy: CategoryPolicy{BatchSize: 10},
+		},
+		{
+			name:    "FIXED_ZERO",
+			policy:  CategoryPolicy{},
+			wantErr: true,
+		},
+		{
+			name: "ADAPTIVE",
+			policy: CategoryPolicy{
+				Adaptive:       true,
+				MinBatchSize:   10,
+				MaxBatchSize:   10000,
+				TargetInterval: time.Second,
+			},
+		},
+		{
+			name: "ADAPTIVE_ZERO_MIN",
+			policy: CategoryPolicy{
+				Adaptive:       true,
+				MaxBatchSize:   10000,
+				TargetInterval: time.Second,
+			},
+			wantErr: true,
+		},
+		{
+			name: "ADAPTIVE_MAX_LESS_THAN_MIN",
+			policy: CategoryPolicy{
+				Adaptive:       true,
+				MinBatchSize:   100,
+				MaxBatchSize:   10,
+				TargetInterval: time.Second,
+			},
+			wantErr: true,
+		},
+		{
+			name: "ADAPTIVE_ZERO_INTERVAL",
+			policy: CategoryPolicy{
+				Adaptive:     true,
+				MinBatchSize: 10,
+				MaxBatchSize: 10000,
+			},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("CategoryPolicy.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_categoryPolicy_adjust(t *testing.T) {
+	policy := CategoryPolicy{
+		Adaptive:       true,
+		MinBatchSize:   10,
+		MaxBatchSize:   1000,
+		TargetInterval: time.Second,
+	}
+	type args struct {
+		current uint64
+		elapsed time.Duration
+	}
+	tests := []struct {
+		name   string
+		policy CategoryPolicy
+		args   args
+		want   uint64
+	}{
+		{
+			name:   "ON_TARGET",
+			policy: policy,
+			args:   args{current: 100, elapsed: time.Second},
+			want:   100,
+		},
+		{
+			name:   "GROW_PROPORTIONALLY",
+			policy: policy,
+			args:   args{current: 100, elapsed: 800 * time.Millisecond},
+			want:   125,
+		},
+		{
+			name:   "GROW_AT_MOST_TWICE",
+			policy: policy,
+			args:   args{current: 100, elapsed: time.Millisecond},
+			want:   200,
+		},
+		{
+			name:   "GROW_TO_MAX",
+			policy: policy,
+			args:   args{current: 800, elapsed: time.Millisecond},
+			want:   1000,
+		},
+		{
+			name:   "SHRINK_AT_MOST_HALF",
+			policy: policy,
+			args:   args{current: 100, elapsed: time.Hour},
+			want:   50,
+		},
+		{
+			name:   "SHRINK_TO_MIN",
+			policy: policy,
+			args:   args{current: 12, elapsed: time.Hour},
+			want:   10,
+		},
+		{
+			name:   "FIXED",
+			policy: CategoryPolicy{BatchSize: 100},
+			args:   args{current: 100, elapsed: time.Millisecond},
+			want:   100,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.policy.adjust(tt.args.current, tt.args.elapsed); got != tt.want {
+				t.Errorf("CategoryPolicy.adjust() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
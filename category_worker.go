@@ -0,0 +1,347 @@
+package id_generator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zale144/id-generator/logger"
+	"sync"
+)
+
+// categoryWorker owns the local ID sets of a single category and serves its
+// requests on its own goroutine, so a slow provider lease for one category
+// never blocks requests for another.
+type categoryWorker struct {
+	gen         *IDGenerator
+	category    string
+	idSet       *IDSet
+	nextIDSet   *IDSet
+	prefetching bool
+	// exposed is set once idSet has been returned by TakeIDsWithRetry, after
+	// which its IDs may be handed out without the worker knowing.
+	exposed bool
+	// hasLease and reserved track the worker's lease, see LeasePolicy.
+	hasLease bool
+	reserved uint64
+	// recovered is set while idSet holds IDs recovered from the journal that
+	// haven't been checked yet, journaled counts the IDs reserved by the
+	// last journal record, see JournalPolicy.
+	recovered    bool
+	journaled    uint64
+	reqChan      chan workerReq
+	prefetchChan chan prefetchResp
+	stopChan     chan struct{}
+	stopOnce     sync.Once
+	// done is closed once the worker goroutine has exited.
+	done chan struct{}
+}
+
+type workerReq struct {
+	ctx  context.Context
+	fn   func(w *categoryWorker) idResp
+	resp chan idResp
+}
+
+type idResp struct {
+	id      uint64
+	set     *IDSet
+	version int32
+	err     error
+}
+
+type prefetchResp struct {
+	set *IDSet
+	err error
+}
+
+func newCategoryWorker(gen *IDGenerator, category string) *categoryWorker {
+	return &categoryWorker{
+		gen:          gen,
+		category:     category,
+		reqChan:      make(chan workerReq),
+		prefetchChan: make(chan prefetchResp, 1),
+		stopChan:     make(chan struct{}),
+		done:         make(chan struct{}),
+	}
+}
+
+func (w *categoryWorker) run() {
+	defer close(w.done)
+	for {
+		select {
+		case req := <-w.reqChan:
+			if err := w.recover(req.ctx); err != nil {
+				req.resp <- idResp{version: -1, err: err}
+				continue
+			}
+			req.resp <- req.fn(w)
+		case p := <-w.prefetchChan:
+			w.prefetched(p)
+		case <-w.stopChan:
+			return
+		}
+	}
+}
+
+func (w *categoryWorker) prefetched(p prefetchResp) {
+	w.prefetching = false
+	if p.err != nil {
+		w.gen.log().Error("error prefetching IDs", logger.String("category", w.category), logger.Error(p.err))
+		if errors.Is(p.err, ErrLeaseLost) {
+			w.dropLocal()
+		}
+		return
+	}
+	w.nextIDSet = p.set
+	if _, ok := w.gen.leasePolicy(); ok {
+		w.hasLease = true
+	}
+	w.journalLocal()
+}
+
+// awaitPrefetch waits for a pending prefetch to be delivered, so the local
+// sets and the lease don't miss the batch it leased.
+func (w *categoryWorker) awaitPrefetch(ctx context.Context) error {
+	if !w.prefetching {
+		return nil
+	}
+	select {
+	case p := <-w.prefetchChan:
+		w.prefetched(p)
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// stop ends the worker goroutine once it finishes the request it is serving.
+// The worker's state may be used directly after done is closed.
+func (w *categoryWorker) stop() {
+	w.stopOnce.Do(func() {
+		close(w.stopChan)
+	})
+}
+
+// exec runs fn on the worker goroutine and waits for its result or for the
+// context to be done.
+func (w *categoryWorker) exec(ctx context.Context, fn func(w *categoryWorker) idResp) idResp {
+	req := workerReq{
+		ctx:  ctx,
+		fn:   fn,
+		resp: make(chan idResp, 1),
+	}
+	select {
+	case w.reqChan <- req:
+	case <-w.done:
+		return idResp{version: -1, err: ErrGeneratorClosed}
+	case <-ctx.Done():
+		return idResp{err: ctx.Err()}
+	}
+	select {
+	case resp := <-req.resp:
+		return resp
+	case <-ctx.Done():
+		return idResp{err: ctx.Err()}
+	}
+}
+
+// takeIDs leases a new batch from the provider and makes it the current set.
+// If expose is set the batch is returned to the caller as a whole.
+func (w *categoryWorker) takeIDs(ctx context.Context, expose bool) idResp {
+	if err := w.awaitPrefetch(ctx); err != nil {
+		return idResp{err: err}
+	}
+	set, err := w.gen.leaseIDs(ctx, w.category, w.leaseBatch(false, expose))
+	if errors.Is(err, ErrLeaseLost) {
+		w.dropLocal()
+	}
+	if err != nil {
+		return idResp{err: err}
+	}
+	w.idSet = set
+	w.exposed = expose
+	w.leaseWritten()
+	return idResp{set: set}
+}
+
+func (w *categoryWorker) takeID(ctx context.Context) idResp {
+	if w.idSet == nil || w.idSet.GetSize() == 0 {
+		if err := w.awaitPrefetch(ctx); err != nil {
+			return idResp{err: err}
+		}
+		if !w.promoteNext() {
+			// the old set is empty, so a failed lease is returned as is
+			if resp := w.takeIDs(ctx, false); resp.err != nil {
+				return idResp{err: resp.err}
+			}
+			w.journalLocal()
+		}
+	}
+	id, err := w.idSet.TakeID()
+	if err != nil {
+		return idResp{err: err}
+	}
+	if err := w.reserve(ctx, 1); err != nil {
+		return w.takeIDFailed(id, err)
+	}
+	if w.idSet != nil {
+		w.prefetchIfLow()
+	}
+	return idResp{id: id}
+}
+
+// takeIDFailed returns an ID taken from the local set unless the local sets
+// were dropped because their lease was lost.
+func (w *categoryWorker) takeIDFailed(id uint64, err error) idResp {
+	if !errors.Is(err, ErrLeaseLost) && w.idSet != nil {
+		taken := NewIDSet([]IDRange{NewIDRange(id, id, false)}, w.category, false)
+		if pErr := w.idSet.PushIDsFromString(taken.String()); pErr != nil {
+			w.gen.log().Error("error returning taken ID to the local set", logger.String("category", w.category), logger.Error(pErr))
+		}
+	}
+	return idResp{err: err}
+}
+
+// reserve accounts for n IDs about to be handed out in the lease and the
+// journal, whichever are enabled.
+func (w *categoryWorker) reserve(ctx context.Context, n uint64) error {
+	if err := w.reserveLease(ctx, n); err != nil {
+		return err
+	}
+	return w.reserveJournal(n)
+}
+
+// takeN takes n IDs, first from the local sets and then directly from the
+// provider for whatever the local sets can't cover.
+func (w *categoryWorker) takeN(ctx context.Context, n uint64) idResp {
+	taken := NewIDSet(nil, w.category, false)
+	remaining := n
+	for remaining > 0 {
+		if w.idSet == nil || w.idSet.GetSize() == 0 {
+			if !w.promoteNext() {
+				break
+			}
+		}
+		part, err := w.idSet.TakeIDs(remaining)
+		if err != nil {
+			return w.takeNFailed(taken, err)
+		}
+		if err := taken.PushIDsFromString(part.String()); err != nil {
+			return w.takeNFailed(taken, err)
+		}
+		remaining -= part.GetSize()
+	}
+	if err := w.reserve(ctx, taken.GetSize()); err != nil {
+		return w.takeNFailed(taken, err)
+	}
+	if remaining > 0 {
+		part, err := w.gen.takeIDsFromProvider(ctx, w.category, remaining, nil)
+		if err != nil {
+			return w.takeNFailed(taken, err)
+		}
+		if err := taken.PushIDsFromString(part.String()); err != nil {
+			return idResp{err: err}
+		}
+	}
+	if w.idSet != nil {
+		w.prefetchIfLow()
+	}
+	return idResp{set: taken}
+}
+
+// takeNFailed returns the IDs already taken from the local sets so they
+// aren't lost when the rest of the request fails.
+func (w *categoryWorker) takeNFailed(taken *IDSet, err error) idResp {
+	if !errors.Is(err, ErrLeaseLost) && w.idSet != nil && taken.GetSize() > 0 {
+		if pErr := w.idSet.PushIDsFromString(taken.String()); pErr != nil {
+			w.gen.log().Error("error returning taken IDs to the local set", logger.String("category", w.category), logger.Error(pErr))
+		}
+	}
+	return idResp{err: err}
+}
+
+// pushIDs returns the current and prefetched sets to the provider.
+func (w *categoryWorker) pushIDs(ctx context.Context) idResp {
+	if w.idSet == nil {
+		return idResp{version: -1, err: fmt.Errorf("no set for category '%s': %w", w.category, ErrCategoryNotFound)}
+	}
+	if w.idSet.IsReadOnly() {
+		return idResp{version: -1, err: fmt.Errorf("cannot push IDs: %w", ErrReadOnly)}
+	}
+	if err := w.awaitPrefetch(ctx); err != nil {
+		return idResp{version: -1, err: err}
+	}
+	if w.idSet == nil {
+		return idResp{version: -1, err: fmt.Errorf("no set for category '%s': %w", w.category, ErrCategoryNotFound)}
+	}
+	if w.nextIDSet != nil {
+		if err := w.idSet.PushIDsFromString(w.nextIDSet.String()); err != nil {
+			return idResp{version: -1, err: err}
+		}
+		w.nextIDSet = nil
+	}
+	version, err := w.gen.pushIDsToProvider(ctx, w.category, w.idSet, w.hasLease)
+	if errors.Is(err, ErrLeaseLost) {
+		w.dropLocal()
+	}
+	if err != nil {
+		return idResp{version: version, err: err}
+	}
+	w.hasLease = false
+	w.reserved = 0
+	w.journalReleased()
+	return idResp{version: version}
+}
+
+// shutdown waits for a pending prefetch and pushes all unused IDs back to
+// the provider. The local sets are closed once they have been pushed.
+func (w *categoryWorker) shutdown(ctx context.Context) idResp {
+	if err := w.awaitPrefetch(ctx); err != nil {
+		return idResp{version: -1, err: err}
+	}
+	if w.idSet == nil {
+		return idResp{version: -1}
+	}
+	if w.idSet.GetSize() == 0 && (w.nextIDSet == nil || w.nextIDSet.GetSize() == 0) {
+		w.idSet.Close()
+		return idResp{version: -1}
+	}
+	resp := w.pushIDs(ctx)
+	if resp.err != nil {
+		return resp
+	}
+	w.idSet.Close()
+	return resp
+}
+
+// promoteNext makes the prefetched set the current set. It returns false if
+// there is no prefetched set.
+func (w *categoryWorker) promoteNext() bool {
+	if w.nextIDSet == nil {
+		return false
+	}
+	w.idSet, w.nextIDSet = w.nextIDSet, nil
+	w.exposed = false
+	return true
+}
+
+// prefetchIfLow leases the next batch in the background once the current
+// set drops to the category's low watermark.
+func (w *categoryWorker) prefetchIfLow() {
+	watermark := w.gen.lowWatermark(w.category)
+	if watermark == 0 || w.prefetching || w.nextIDSet != nil {
+		return
+	}
+	if w.idSet.GetSize() > watermark {
+		return
+	}
+	w.prefetching = true
+	lease := w.leaseBatch(true, false)
+	go func() {
+		set, err := w.gen.leaseIDs(context.Background(), w.category, lease)
+		w.prefetchChan <- prefetchResp{
+			set: set,
+			err: err,
+		}
+	}()
+}
@@ -0,0 +1,22 @@
+package id_generator
+
+import "github.com/zale144/id-generator/errs"
+
+// Errors returned by the generator and its ID sets, see package errs.
+var (
+	ErrExhausted        = errs.ErrExhausted
+	ErrReadOnly         = errs.ErrReadOnly
+	ErrVersionConflict  = errs.ErrVersionConflict
+	ErrCategoryNotFound = errs.ErrCategoryNotFound
+	ErrLockTimeout      = errs.ErrLockTimeout
+	ErrEmptySet         = errs.ErrEmptySet
+	ErrOverlap          = errs.ErrOverlap
+	ErrCategoryMismatch = errs.ErrCategoryMismatch
+	ErrDisconnected     = errs.ErrDisconnected
+	ErrSetClosed        = errs.ErrSetClosed
+	ErrGeneratorClosed  = errs.ErrGeneratorClosed
+	ErrLeaseLost        = errs.ErrLeaseLost
+)
+
+// ProviderError is returned for failures of the provider's backing store.
+type ProviderError = errs.ProviderError
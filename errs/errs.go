@@ -0,0 +1,74 @@
+// Package errs defines the errors returned by the ID generator, its ID sets
+// and its providers. Errors are wrapped with context on the way up, so check
+// for them with errors.Is and errors.As.
+package errs
+
+import (
+	"errors"
+	"fmt"
+)
+
+var (
+	// ErrExhausted is returned when there are no IDs left to take.
+	ErrExhausted = errors.New("no IDs remaining")
+	// ErrReadOnly is returned when modifying a read only ID set or range.
+	ErrReadOnly = errors.New("ID set is read only")
+	// ErrVersionConflict is returned by providers when the state was changed
+	// since the version being written was read.
+	ErrVersionConflict = errors.New("version doesn't match")
+	// ErrCategoryNotFound is returned when a category has no state.
+	ErrCategoryNotFound = errors.New("category not found")
+	// ErrLockTimeout is returned when a category lock can't be acquired.
+	ErrLockTimeout = errors.New("timed out acquiring lock")
+	// ErrEmptySet is returned when pushing an ID set without IDs.
+	ErrEmptySet = errors.New("ID set is empty")
+	// ErrOverlap is returned when pushed IDs overlap with IDs already in a set.
+	ErrOverlap = errors.New("ID ranges overlap")
+	// ErrCategoryMismatch is returned when pushing IDs to a set of another
+	// category.
+	ErrCategoryMismatch = errors.New("categories don't match")
+	// ErrDisconnected is returned by providers while they aren't connected to
+	// their backing store, instead of waiting for the connection to return.
+	ErrDisconnected = errors.New("not connected to the provider")
+	// ErrSetClosed is returned when modifying a closed ID set.
+	ErrSetClosed = errors.New("ID set is closed")
+	// ErrGeneratorClosed is returned by calls made after the generator was
+	// closed.
+	ErrGeneratorClosed = errors.New("id generator is closed")
+	// ErrLeaseLost is returned when a generator's lease expired and another
+	// generator reclaimed its IDs.
+	ErrLeaseLost = errors.New("lease expired and its IDs were reclaimed")
+)
+
+// ProviderError is returned by providers for failures of the backing store.
+// Kind is the sentinel error the failure maps to, if any, and Err is the
+// error returned by the store's client.
+type ProviderError struct {
+	Op       string
+	Category string
+	Kind     error
+	Err      error
+}
+
+func (e *ProviderError) Error() string {
+	msg := e.Op
+	if e.Category != "" {
+		msg += fmt.Sprintf(" '%s'", e.Category)
+	}
+	if e.Kind != nil {
+		msg += ": " + e.Kind.Error()
+	}
+	if e.Err != nil {
+		msg += ": " + e.Err.Error()
+	}
+	return msg
+}
+
+func (e *ProviderError) Unwrap() error {
+	return e.Err
+}
+
+// Is reports whether target is the sentinel error the failure maps to.
+func (e *ProviderError) Is(target error) bool {
+	return e.Kind != nil && target == e.Kind
+}
@@ -1,9 +1,15 @@
 package id_generator
 
 import (
+	"context"
 	"errors"
 	"fmt"
-	"log"
+	"github.com/zale144/id-generator/logger"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -14,190 +20,543 @@ const (
 
 type IDGenerator struct {
 	idProvider IDProvider
-	idSets     map[string]*IDSet
-	idReqChan  chan idReq
+	workers    map[string]*categoryWorker
+	workersMu  sync.Mutex
+	closed     bool
+	inFlight   sync.WaitGroup
+	closeMu    sync.Mutex
+	unflushed  []*categoryWorker
+	flushed    bool
+	leases     *LeasePolicy
+	stopLeases chan struct{}
+	journal    *journal
+	logger     atomic.Value
+	categories map[string]*categoryState
+	catMu      sync.Mutex
+	retries    RetryPolicy
+	now        func() time.Time
 }
 
+// IDProvider stores the state of the categories. GetData reports a category
+// that doesn't exist with an error matching ErrCategoryNotFound, for which the
+// generator initializes the category. Empty data is treated the same way.
 type IDProvider interface {
-	GetData(category string) (string, int32, error)
-	SetData(data, category string, version int32) error
-	Initialize(iniSet string, category string) error
-	Delete(category string, version int32) error
-	Lock(category string) (interface{}, error)
-	Unlock(lck interface{}) error
+	GetData(ctx context.Context, category string) (string, int32, error)
+	SetData(ctx context.Context, data, category string, version int32) error
+	Initialize(ctx context.Context, iniSet string, category string) error
+	Delete(ctx context.Context, category string, version int32) error
+	Lock(ctx context.Context, category string) (interface{}, error)
+	Unlock(ctx context.Context, lck interface{}) error
+}
+
+// AtomicIDProvider is implemented by providers that can take IDs from a
+// category's state in a single atomic operation on the server. When
+// AtomicTake returns true the generator takes IDs through TakeIDs instead of
+// locking the category and updating its state, unless leases are enabled.
+type AtomicIDProvider interface {
+	AtomicTake() bool
+	// TakeIDs takes up to size IDs from the front of the category's state and
+	// returns them as a serialized ID set. It fails with ErrCategoryNotFound if
+	// the category has no state and ErrExhausted if it has no IDs left.
+	TakeIDs(ctx context.Context, category string, size uint64) (string, error)
+}
+
+// ConnectionAware is implemented by providers that track the connection to
+// their backing store.
+type ConnectionAware interface {
+	Connected() bool
 }
 
 func NewIDGenerator(provider IDProvider) *IDGenerator {
 
 	gen := &IDGenerator{
 		idProvider: provider,
-		idSets:     make(map[string]*IDSet),
-		idReqChan:  make(chan idReq),
+		workers:    make(map[string]*categoryWorker),
+		categories: make(map[string]*categoryState),
+		retries:    DefaultRetryPolicy,
+		now:        time.Now,
 	}
-	go gen.takeIDHandler()
+	gen.SetLogger(logger.NewStd())
 
 	return gen
 }
 
+type loggerHolder struct {
+	logger.Logger
+}
+
+// SetLogger sets the logger the generator writes to. A nil logger discards
+// everything. The default logger writes messages of level Info and above
+// through the standard log package.
+func (g *IDGenerator) SetLogger(l logger.Logger) {
+	if l == nil {
+		l = logger.NewNop()
+	}
+	g.logger.Store(loggerHolder{l})
+}
+
+func (g *IDGenerator) log() logger.Logger {
+	return g.logger.Load().(loggerHolder)
+}
+
+// Connected reports whether the provider is connected to its backing store.
+// Providers that don't track their connection are always reported connected.
+func (g *IDGenerator) Connected() bool {
+	if p, ok := g.idProvider.(ConnectionAware); ok {
+		return p.Connected()
+	}
+	return true
+}
+
+// worker returns the worker serving the category, starting it if needed.
+func (g *IDGenerator) worker(category string) *categoryWorker {
+	g.workersMu.Lock()
+	defer g.workersMu.Unlock()
+	w, ok := g.workers[category]
+	if !ok {
+		w = newCategoryWorker(g, category)
+		g.workers[category] = w
+		go w.run()
+	}
+	return w
+}
+
+// begin registers an in-flight call, failing if the generator is closed.
+// Every successful begin must be paired with g.inFlight.Done.
+func (g *IDGenerator) begin() error {
+	g.workersMu.Lock()
+	defer g.workersMu.Unlock()
+	if g.closed {
+		return ErrGeneratorClosed
+	}
+	g.inFlight.Add(1)
+	return nil
+}
+
+func (g *IDGenerator) lookupWorker(category string) (*categoryWorker, bool) {
+	g.workersMu.Lock()
+	defer g.workersMu.Unlock()
+	w, ok := g.workers[category]
+	return w, ok
+}
+
+// RegisterCategory sets the leasing policy for a category. Categories that
+// are not registered lease DefaultIDSetSize IDs at a time.
+func (g *IDGenerator) RegisterCategory(category string, policy CategoryPolicy) error {
+	if category == "" {
+		return errors.New("category must not be empty")
+	}
+	if err := policy.validate(); err != nil {
+		return errors.New(fmt.Sprintf("invalid policy for category '%s': %s", category, err))
+	}
+	g.catMu.Lock()
+	g.categories[category] = newCategoryState(policy)
+	g.catMu.Unlock()
+	return nil
+}
+
+// BatchSize returns the number of IDs the category currently leases from the
+// provider at a time. In adaptive mode this is the size of the last lease.
+func (g *IDGenerator) BatchSize(category string) uint64 {
+	g.catMu.Lock()
+	defer g.catMu.Unlock()
+	if c, ok := g.categories[category]; ok {
+		return c.batchSize
+	}
+	return DefaultIDSetSize
+}
+
+func (g *IDGenerator) lowWatermark(category string) uint64 {
+	g.catMu.Lock()
+	defer g.catMu.Unlock()
+	if c, ok := g.categories[category]; ok {
+		return c.policy.LowWatermark
+	}
+	return 0
+}
+
+func (g *IDGenerator) nextBatchSize(category string) uint64 {
+	g.catMu.Lock()
+	defer g.catMu.Unlock()
+	if c, ok := g.categories[category]; ok {
+		return c.nextBatchSize(g.now())
+	}
+	return DefaultIDSetSize
+}
+
+func (g *IDGenerator) leased(category string, size uint64) {
+	g.catMu.Lock()
+	defer g.catMu.Unlock()
+	if c, ok := g.categories[category]; ok {
+		c.leased(size, g.now())
+	}
+}
+
 func (g *IDGenerator) Initialize(category string, startID uint64) error {
-	set, err := g.PeekIDs(category)
+	return g.InitializeContext(context.Background(), category, startID)
+}
+
+func (g *IDGenerator) InitializeContext(ctx context.Context, category string, startID uint64) error {
+	set, err := g.PeekIDsContext(ctx, category)
 	if err != nil {
-		log.Println(err.Error())
+		return err
 	}
 	if set != nil && set.GetSize() != 0 {
-		log.Println("set for category already exists")
+		g.log().Debug("set for category already exists", logger.String("category", category))
 		return nil
 	}
 	currIDs := NewIDSet([]IDRange{
 		NewIDRange(startID, defaultTotalSize, false),
 	}, category, false)
-	return g.idProvider.Initialize(currIDs.String(), category)
+	return g.idProvider.Initialize(ctx, currIDs.String(), category)
 }
 
 func (g *IDGenerator) TakeIDsWithRetry(category string) (s *IDSet, rErr error) {
-	currTryCount := 0
-	success := false
-	var takenIDs *IDSet
-	var errFin error
+	return g.TakeIDsWithRetryContext(context.Background(), category)
+}
 
-	lock, err := g.idProvider.Lock(category)
-	if err != nil {
+func (g *IDGenerator) TakeIDsWithRetryContext(ctx context.Context, category string) (s *IDSet, rErr error) {
+	if err := g.begin(); err != nil {
 		return nil, err
 	}
-	defer g.idProvider.Unlock(lock)
-
-	for !success && currTryCount <= maxTryCount {
-
-		if currTryCount > 1 {
-			log.Println(fmt.Sprintf("attempt %d of %d", currTryCount, maxTryCount))
+	defer g.inFlight.Done()
+	resp := g.worker(category).exec(ctx, func(w *categoryWorker) idResp {
+		resp := w.takeIDs(ctx, true)
+		if resp.err == nil {
+			w.journalLocal()
 		}
-		currTryCount++
+		return resp
+	})
+	return resp.set, resp.err
+}
 
-		// get data
-		currData, version, err := g.idProvider.GetData(category)
-		if err != nil {
-			return nil, err
-		}
-		// TODO - probably delete
-		if len(currData) == 0 {
-			if err = g.Initialize(category, 1); err != nil {
-				return nil, err
-			}
-			continue
-		}
-		// deserialize data
-		currIDs, err := IDSetFromString(currData)
-		if err != nil {
-			return nil, err
-		}
-		// take IDs
-		takenIDs, err = currIDs.TakeIDs(DefaultIDSetSize)
-		if err != nil {
-			return nil, err
-		}
+// leaseIDs takes a batch of IDs for the category from the provider without
+// making it the current set. A non-nil lease is applied to the state in the
+// same write as the batch is taken, see categoryWorker.leaseBatch.
+func (g *IDGenerator) leaseIDs(ctx context.Context, category string, lease func(currIDs, takenIDs *IDSet) error) (*IDSet, error) {
+	batchSize := g.nextBatchSize(category)
+	takenIDs, err := g.takeIDsFromProvider(ctx, category, batchSize, lease)
+	if err != nil {
+		return nil, err
+	}
+	g.leased(category, batchSize)
+	return takenIDs, nil
+}
 
-		// try to set data
-		setStr := takenIDs.String()
-		size := takenIDs.GetSize()
-		if errFin = g.idProvider.SetData(currIDs.String(), category, version); errFin != nil {
-			log.Println("error saving data", errFin)
-		} else {
-			success = true
-			log.Println("fetched a new ID batch from provider = ", "SET: ", setStr, "SIZE: ", size)
+func (g *IDGenerator) takeIDsFromProvider(ctx context.Context, category string, size uint64, lease func(currIDs, takenIDs *IDSet) error) (*IDSet, error) {
+	if p, ok := g.idProvider.(AtomicIDProvider); ok && p.AtomicTake() {
+		// expired leases are only reclaimed by updates of the whole state
+		if _, leases := g.leasePolicy(); !leases {
+			return g.takeIDsAtomically(ctx, p, category, size)
 		}
 	}
-	if !success {
-		errMsg := "failed to take IDs"
-		log.Println(errMsg, errFin)
-		return nil, errors.New(fmt.Sprintf(errMsg+": %s", errFin))
+	var takenIDs *IDSet
+	_, err := g.updateWithRetry(ctx, category, true, "failed to take IDs", func(currIDs *IDSet) (err error) {
+		// take IDs
+		takenIDs, err = currIDs.TakeIDs(size)
+		if err != nil || lease == nil {
+			return err
+		}
+		return lease(currIDs, takenIDs)
+	})
+	if err != nil {
+		return nil, err
 	}
-	g.idSets[category] = takenIDs
+	g.log().Debug("fetched a new ID batch from provider",
+		logger.String("category", category),
+		logger.String("range", takenIDs.String()),
+		logger.Uint64("size", takenIDs.GetSize()))
 	return takenIDs, nil
 }
 
-func (g *IDGenerator) PushIDsWithRetry(category string) (v int32, rErr error) {
-	idSet, ok := g.idSets[category]
-	if !ok {
-		return -1, errors.New(fmt.Sprintf("no set for category '%s'\n", category))
+// takeIDsAtomically takes IDs through the provider's TakeIDs, initializing
+// the category first if it has no state.
+func (g *IDGenerator) takeIDsAtomically(ctx context.Context, p AtomicIDProvider, category string, size uint64) (*IDSet, error) {
+	data, err := p.TakeIDs(ctx, category, size)
+	if errors.Is(err, ErrCategoryNotFound) {
+		if err = g.InitializeContext(ctx, category, 1); err != nil {
+			return nil, err
+		}
+		data, err = p.TakeIDs(ctx, category, size)
 	}
-	if idSet.IsReadOnly() {
-		return -1, errors.New("cannot push IDs, ID set is read only")
+	if err != nil {
+		return nil, fmt.Errorf("failed to take IDs: %w", err)
 	}
+	takenIDs, err := IDSetFromString(data)
+	if err != nil {
+		return nil, err
+	}
+	g.log().Debug("took a new ID batch from provider atomically",
+		logger.String("category", category),
+		logger.String("range", takenIDs.String()),
+		logger.Uint64("size", takenIDs.GetSize()))
+	return takenIDs, nil
+}
 
-	currTryCount := 0
-	success := false
+// updateWithRetry applies update to the category's state under the provider
+// lock, retrying on version conflicts as set by the generator's RetryPolicy.
+// Expired leases of other owners are reclaimed as part of every update. If
+// initEmpty is set a missing state is initialized, otherwise it is an error.
+func (g *IDGenerator) updateWithRetry(ctx context.Context, category string, initEmpty bool, errMsg string, update func(currIDs *IDSet) error) (int32, error) {
+	policy := g.retryPolicy()
+	start := time.Now()
 	var errFin error
-	var version int32
 
-	lock, err := g.idProvider.Lock(category)
+	lock, err := g.idProvider.Lock(ctx, category)
 	if err != nil {
 		return -1, err
 	}
-	defer g.idProvider.Unlock(lock)
+	defer g.idProvider.Unlock(context.Background(), lock)
 
-	for !success && currTryCount <= maxTryCount {
-		if currTryCount > 1 {
-			log.Println(fmt.Sprintf("attempt %d of %d", currTryCount, maxTryCount))
+	for attempt := 1; attempt <= policy.MaxAttempts; attempt++ {
+		if err := ctx.Err(); err != nil {
+			return -1, err
+		}
+		if attempt > 1 {
+			g.log().Debug("retrying update",
+				logger.String("category", category),
+				logger.Int("attempt", attempt),
+				logger.Int("maxAttempts", policy.MaxAttempts))
 		}
-		currTryCount++
 
 		// get data
-		currData, ver, err := g.idProvider.GetData(category)
+		currData, version, err := g.getData(ctx, category)
 		if err != nil {
 			return -1, err
 		}
-		if idSet.GetSize() == 0 {
-			return ver, errors.New("cannot push IDs, ID set is empty")
-		}
-		version = ver
-		var currIDs *IDSet
 		if len(currData) == 0 {
-			return -1, errors.New(fmt.Sprintf("no data for category '%s'", category))
-		} else {
-			// deserialize data
-			currIDs, err = IDSetFromString(string(currData))
-			if err != nil {
+			if !initEmpty {
+				return -1, fmt.Errorf("no data for category '%s': %w", category, ErrCategoryNotFound)
+			}
+			if err = g.InitializeContext(ctx, category, 1); err != nil {
 				return -1, err
 			}
+			continue
 		}
-		// push IDs
-		if err = currIDs.PushIDsFromString(idSet.String()); err != nil {
+		// deserialize data
+		currIDs, err := IDSetFromString(currData)
+		if err != nil {
 			return -1, err
 		}
-		// try to save data
-		setStr := idSet.String()
-		size := idSet.GetSize()
-		stateStr := currIDs.String()
-		if errFin = g.idProvider.SetData(stateStr, category, version); errFin != nil {
-			log.Println("error saving data", errFin)
-		} else {
-			success = true
-			log.Println("pushed ID set back to provider = ", "SET: ", setStr, "SIZE: ", size, "STATE: ", stateStr)
+		if err = g.reapLeases(category, currIDs); err != nil {
+			return -1, err
+		}
+		if err = update(currIDs); err != nil {
+			return -1, err
+		}
+		// try to set data
+		errFin = g.idProvider.SetData(ctx, currIDs.String(), category, version)
+		if errFin == nil {
+			return version, nil
+		}
+		if !errors.Is(errFin, ErrVersionConflict) {
+			g.log().Error(errMsg, logger.String("category", category), logger.Error(errFin))
+			return -1, fmt.Errorf(errMsg+": %w", errFin)
+		}
+		g.log().Warn("version conflict saving data",
+			logger.String("category", category),
+			logger.Int("attempt", attempt),
+			logger.Error(errFin))
+		if attempt == policy.MaxAttempts {
+			break
+		}
+		delay := policy.backoff(attempt)
+		if policy.MaxElapsed > 0 && time.Since(start)+delay > policy.MaxElapsed {
+			break
+		}
+		if err := sleep(ctx, delay); err != nil {
+			return -1, err
 		}
 	}
-	if !success {
-		errMsg := "failed to push IDs"
-		log.Println(errMsg, errFin)
-		return -1, errors.New(fmt.Sprintf(errMsg+": %s", errFin))
+	if errFin == nil {
+		errFin = fmt.Errorf("no data for category '%s' after initializing it: %w", category, ErrCategoryNotFound)
 	}
+	g.log().Error(errMsg, logger.String("category", category), logger.Error(errFin))
+	return -1, fmt.Errorf(errMsg+": %w", errFin)
+}
+
+func (g *IDGenerator) PushIDsWithRetry(category string) (v int32, rErr error) {
+	return g.PushIDsWithRetryContext(context.Background(), category)
+}
+
+func (g *IDGenerator) PushIDsWithRetryContext(ctx context.Context, category string) (v int32, rErr error) {
+	if err := g.begin(); err != nil {
+		return -1, err
+	}
+	defer g.inFlight.Done()
+	w, ok := g.lookupWorker(category)
+	if !ok {
+		return -1, fmt.Errorf("no set for category '%s': %w", category, ErrCategoryNotFound)
+	}
+	resp := w.exec(ctx, func(w *categoryWorker) idResp {
+		return w.pushIDs(ctx)
+	})
+	return resp.version, resp.err
+}
+
+// pushIDsToProvider returns the IDs in idSet to the category's state in the
+// provider and drops the generator's lease on them. If hasLease is set and
+// the lease has been reclaimed in the meantime, ErrLeaseLost is returned.
+func (g *IDGenerator) pushIDsToProvider(ctx context.Context, category string, idSet *IDSet, hasLease bool) (int32, error) {
+	if idSet.GetSize() == 0 {
+		return -1, fmt.Errorf("cannot push IDs: %w", ErrEmptySet)
+	}
+	setStr := idSet.String()
+	var stateStr string
+	version, err := g.updateWithRetry(ctx, category, false, "failed to push IDs", func(currIDs *IDSet) error {
+		if err := g.releaseLease(currIDs, hasLease); err != nil {
+			return err
+		}
+		// push IDs
+		if err := currIDs.PushIDsFromString(setStr); err != nil {
+			return err
+		}
+		stateStr = currIDs.String()
+		return nil
+	})
+	if err != nil {
+		return -1, err
+	}
+	g.log().Debug("pushed ID set back to provider",
+		logger.String("category", category),
+		logger.String("range", setStr),
+		logger.Uint64("size", idSet.GetSize()),
+		logger.String("state", stateStr))
 	return version, nil
 }
 
 func (g *IDGenerator) Stop() int32 {
-	log.Println("pushing back unused IDs ...")
+	return g.StopContext(context.Background())
+}
+
+func (g *IDGenerator) StopContext(ctx context.Context) int32 {
+	g.log().Info("pushing back unused IDs")
 	var version int32
 	var err error
-	for c := range g.idSets {
-		version, err = g.PushIDsWithRetry(c)
+	g.workersMu.Lock()
+	categories := make([]string, 0, len(g.workers))
+	for c := range g.workers {
+		categories = append(categories, c)
+	}
+	g.workersMu.Unlock()
+	for _, c := range categories {
+		version, err = g.PushIDsWithRetryContext(ctx, c)
 		if err != nil {
-			log.Println("error pushing sets", err)
+			g.log().Error("error pushing sets", logger.String("category", c), logger.Error(err))
 		}
 	}
 	return version
 }
 
+// CloseError lists the categories whose IDs could not be pushed back on Close.
+type CloseError struct {
+	Errors map[string]error
+}
+
+func (e *CloseError) Error() string {
+	categories := make([]string, 0, len(e.Errors))
+	for c := range e.Errors {
+		categories = append(categories, c)
+	}
+	sort.Strings(categories)
+	msgs := make([]string, 0, len(categories))
+	for _, c := range categories {
+		msgs = append(msgs, fmt.Sprintf("'%s': %s", c, e.Errors[c]))
+	}
+	return "failed to push IDs for categories " + strings.Join(msgs, ", ")
+}
+
+// Close rejects new calls with ErrGeneratorClosed, waits for in-flight calls
+// to finish, pushes the unused IDs of every category back to the provider and
+// stops the category workers. If ctx is done first, the workers are stopped,
+// ctx.Err() is returned and calling Close again retries the categories that
+// were not pushed back yet. Failures of individual categories are returned as
+// a *CloseError.
+func (g *IDGenerator) Close(ctx context.Context) error {
+	g.closeMu.Lock()
+	defer g.closeMu.Unlock()
+	g.workersMu.Lock()
+	if g.flushed {
+		g.workersMu.Unlock()
+		return ErrGeneratorClosed
+	}
+	if !g.closed {
+		g.closed = true
+		if g.stopLeases != nil {
+			close(g.stopLeases)
+		}
+		for _, w := range g.workers {
+			g.unflushed = append(g.unflushed, w)
+		}
+	}
+	g.workersMu.Unlock()
+
+	drained := make(chan struct{})
+	go func() {
+		g.inFlight.Wait()
+		close(drained)
+	}()
+	select {
+	case <-drained:
+	case <-ctx.Done():
+	}
+	// the workers are stopped on every path, the IDs of the categories not
+	// pushed yet stay with the stopped workers until Close is called again
+	for _, w := range g.unflushed {
+		w.stop()
+	}
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+
+	errs := make(map[string]error)
+	for len(g.unflushed) > 0 {
+		w := g.unflushed[0]
+		select {
+		case <-w.done:
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+		resp := w.shutdown(ctx)
+		if resp.err != nil {
+			if ctxErr := ctx.Err(); ctxErr != nil {
+				return ctxErr
+			}
+			errs[w.category] = resp.err
+			g.log().Error("error pushing sets", logger.String("category", w.category), logger.Error(resp.err))
+		}
+		g.unflushed = g.unflushed[1:]
+	}
+	g.workersMu.Lock()
+	g.flushed = true
+	g.workersMu.Unlock()
+	if g.journal != nil {
+		if err := g.journal.close(); err != nil {
+			g.log().Error("error closing journal", logger.Error(err))
+		}
+	}
+	if len(errs) > 0 {
+		return &CloseError{Errors: errs}
+	}
+	return nil
+}
+
 func (g *IDGenerator) PeekIDs(category string) (*IDSet, error) {
-	data, _, err := g.idProvider.GetData(category)
+	return g.PeekIDsContext(context.Background(), category)
+}
+
+// getData returns the category's state from the provider, or empty data if
+// the category doesn't exist.
+func (g *IDGenerator) getData(ctx context.Context, category string) (string, int32, error) {
+	data, version, err := g.idProvider.GetData(ctx, category)
+	if errors.Is(err, ErrCategoryNotFound) {
+		return "", -1, nil
+	}
+	return data, version, err
+}
+
+func (g *IDGenerator) PeekIDsContext(ctx context.Context, category string) (*IDSet, error) {
+	data, _, err := g.getData(ctx, category)
 	if err != nil {
 		return nil, err
 	}
@@ -212,47 +571,39 @@ func (g *IDGenerator) PeekIDs(category string) (*IDSet, error) {
 	return currIDs, err
 }
 
-type idReq struct {
-	category string
-	resp     chan idResp
+func (g *IDGenerator) TakeID(category string) (uint64, error) {
+	return g.TakeIDContext(context.Background(), category)
 }
 
-type idResp struct {
-	id  uint64
-	err error
+func (g *IDGenerator) TakeIDContext(ctx context.Context, category string) (uint64, error) {
+	if err := g.begin(); err != nil {
+		return 0, err
+	}
+	defer g.inFlight.Done()
+	resp := g.worker(category).exec(ctx, func(w *categoryWorker) idResp {
+		return w.takeID(ctx)
+	})
+	return resp.id, resp.err
 }
 
-func (g *IDGenerator) takeIDHandler() {
-	for {
-		req := <-g.idReqChan
-
-		var set *IDSet
-		var err error
-		var rsp idResp
-		set, ok := g.idSets[req.category]
-		if !ok || set.GetSize() == 0 {
-			_, err = g.TakeIDsWithRetry(req.category)
-			if err != nil {
-				rsp.err = err
-			}
-			set = g.idSets[req.category]
-		}
-		if set != nil {
-			id, err := set.TakeID()
-			rsp.id = id
-			rsp.err = err
-		}
-
-		req.resp <- rsp
-	}
+// TakeN takes n IDs for the category in a single call. IDs left in the local
+// buffer are used first and the remainder is leased directly from the
+// provider, bypassing the category's batch size. The returned set may hold
+// fewer than n IDs if the category is close to exhaustion.
+func (g *IDGenerator) TakeN(category string, n uint64) (*IDSet, error) {
+	return g.TakeNContext(context.Background(), category, n)
 }
 
-func (g *IDGenerator) TakeID(category string) (uint64, error) {
-	req := idReq{
-		category: category,
-		resp:     make(chan idResp),
+func (g *IDGenerator) TakeNContext(ctx context.Context, category string, n uint64) (*IDSet, error) {
+	if n == 0 {
+		return nil, errors.New("number of IDs to take must be greater than 0")
 	}
-	g.idReqChan <- req
-	resp := <-req.resp
-	return resp.id, resp.err
+	if err := g.begin(); err != nil {
+		return nil, err
+	}
+	defer g.inFlight.Done()
+	resp := g.worker(category).exec(ctx, func(w *categoryWorker) idResp {
+		return w.takeN(ctx, n)
+	})
+	return resp.set, resp.err
 }
@@ -0,0 +1,90 @@
+//go:build darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || windows
+// +build darwin dragonfly freebsd illumos linux netbsd openbsd windows
+
+package id_generator
+
+import (
+	"context"
+	"errors"
+	"github.com/zale144/id-generator/provider"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+)
+
+func Test_idGenerator_TakeIDFile(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "ids.json")
+	fileIDProvider, err := provider.NewFileIDProvider(path)
+	if err != nil {
+		t.Fatalf("provider.NewFileIDProvider error = %v", err)
+	}
+	// a second provider on the same file stands in for another process
+	otherIDProvider, err := provider.NewFileIDProvider(path)
+	if err != nil {
+		t.Fatalf("provider.NewFileIDProvider error = %v", err)
+	}
+
+	// a missing category is initialized on the first take
+	wg := sync.WaitGroup{}
+	for _, p := range []IDProvider{fileIDProvider, otherIDProvider} {
+		wg.Add(1)
+		go func(p IDProvider) {
+			defer wg.Done()
+			takeIDsConcurrently(t, p, OperationIdCategory)
+		}(p)
+	}
+	wg.Wait()
+
+	// the state survives a restart
+	restarted, err := provider.NewFileIDProvider(path)
+	if err != nil {
+		t.Fatalf("provider.NewFileIDProvider error = %v", err)
+	}
+	g := NewIDGenerator(restarted)
+	before, err := g.PeekIDs(OperationIdCategory)
+	if err != nil {
+		t.Fatalf("IDGenerator.PeekIDs() error = %v", err)
+	}
+	id, err := g.TakeID(OperationIdCategory)
+	if err != nil {
+		t.Fatalf("IDGenerator.TakeID() error = %v", err)
+	}
+	if want := before.ranges()[0].CurrentStartID; id != want {
+		t.Errorf("IDGenerator.TakeID() = %v, want %v", id, want)
+	}
+	g.Stop()
+
+	ctx := context.Background()
+	data, version, err := restarted.GetData(ctx, OperationIdCategory)
+	if err != nil {
+		t.Fatalf("IDProvider.GetData() error = %v", err)
+	}
+	if err := restarted.SetData(ctx, data, OperationIdCategory, version); err != nil {
+		t.Errorf("IDProvider.SetData() error = %v", err)
+	}
+	if err := restarted.SetData(ctx, data, OperationIdCategory, version); !errors.Is(err, ErrVersionConflict) {
+		t.Errorf("IDProvider.SetData() error = %v, want %v", err, ErrVersionConflict)
+	}
+
+	// the lock is exclusive until released
+	lock, err := fileIDProvider.Lock(ctx, OperationIdCategory)
+	if err != nil {
+		t.Fatalf("IDProvider.Lock() error = %v", err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 50*time.Millisecond)
+	defer cancel()
+	if _, err := otherIDProvider.Lock(timeoutCtx, OperationIdCategory); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("IDProvider.Lock() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := fileIDProvider.Unlock(ctx, lock); err != nil {
+		t.Errorf("IDProvider.Unlock() error = %v", err)
+	}
+
+	if err := restarted.Delete(ctx, OperationIdCategory, -1); err != nil {
+		t.Errorf("IDProvider.Delete() error = %v", err)
+	}
+	if _, _, err := fileIDProvider.GetData(ctx, OperationIdCategory); !errors.Is(err, ErrCategoryNotFound) {
+		t.Errorf("IDProvider.GetData() error = %v, want %v", err, ErrCategoryNotFound)
+	}
+}
@@ -3,8 +3,10 @@
 package id_generator
 
 import (
+	"context"
 	"fmt"
 	"testing"
+	"time"
 
 	"github.com/zale144/id-generator/provider"
 )
@@ -143,7 +145,7 @@ func Test_idGenerator_TakeAndPushIDsWithRetry(t *testing.T) {
 		NewIDRange(1, defaultTotalSize, false),
 	}, OperationIdCategory, false)
 	idP := provider.NewMockIDProvider()
-	if err := idP.Initialize(set.String(), OperationIdCategory); err != nil {
+	if err := idP.Initialize(context.Background(), set.String(), OperationIdCategory); err != nil {
 		t.Errorf("idProvider.Initialize() error = %v", err)
 		return
 	}
@@ -239,3 +241,235 @@ func Test_idGenerator_TakeAndPushIDsWithRetry(t *testing.T) {
 		t.Log(fmt.Sprintf("state after push:  %s\n", stateAfterStr))
 	}
 }
+
+func Test_idGenerator_RegisterCategory(t *testing.T) {
+	type args struct {
+		category string
+		policy   CategoryPolicy
+	}
+	tests := []struct {
+		name         string
+		args         args
+		wantTakenIDs *IDSet
+		wantState    *IDSet
+		wantErr      bool
+	}{
+		{
+			name: "BATCH_SIZE_10000",
+			args: args{
+				category: "order_uid",
+				policy:   CategoryPolicy{BatchSize: 10000},
+			},
+			wantTakenIDs: NewIDSet([]IDRange{
+				NewIDRange(1, 10000, false),
+			}, "order_uid", false),
+			wantState: NewIDSet([]IDRange{
+				NewIDRange(10001, defaultTotalSize, false),
+			}, "order_uid", false),
+		},
+		{
+			name: "BATCH_SIZE_1",
+			args: args{
+				category: "tenant_uid",
+				policy:   CategoryPolicy{BatchSize: 1},
+			},
+			wantTakenIDs: NewIDSet([]IDRange{
+				NewIDRange(1, 1, false),
+			}, "tenant_uid", false),
+			wantState: NewIDSet([]IDRange{
+				NewIDRange(2, defaultTotalSize, false),
+			}, "tenant_uid", false),
+		},
+		{
+			name: "BATCH_SIZE_0",
+			args: args{
+				category: "invalid_uid",
+				policy:   CategoryPolicy{BatchSize: 0},
+			},
+			wantErr: true,
+		},
+		{
+			name: "EMPTY_CATEGORY",
+			args: args{
+				policy: CategoryPolicy{BatchSize: 10},
+			},
+			wantErr: true,
+		},
+	}
+	idP := provider.NewMockIDProvider()
+	g := NewIDGenerator(idP)
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := g.RegisterCategory(tt.args.category, tt.args.policy)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("IDGenerator.RegisterCategory() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			if tt.wantErr {
+				if size := g.BatchSize(tt.args.category); size != DefaultIDSetSize {
+					t.Errorf("IDGenerator.BatchSize() = %v, want %v", size, DefaultIDSetSize)
+				}
+				return
+			}
+			if size := g.BatchSize(tt.args.category); size != tt.args.policy.BatchSize {
+				t.Errorf("IDGenerator.BatchSize() = %v, want %v", size, tt.args.policy.BatchSize)
+			}
+			if err := g.Initialize(tt.args.category, 1); err != nil {
+				t.Errorf("IDGenerator.Initialize() error = %v", err)
+				return
+			}
+			gotTakenIDs, err := g.TakeIDsWithRetry(tt.args.category)
+			if err != nil {
+				t.Errorf("IDGenerator.TakeIDsWithRetry() error = %v", err)
+				return
+			}
+			taken := gotTakenIDs.String()
+			want := tt.wantTakenIDs.String()
+			if taken != want {
+				t.Errorf("IDGenerator.TakeIDsWithRetry() = %v, want %v", taken, want)
+			}
+			s, err := g.PeekIDs(tt.args.category)
+			if err != nil {
+				t.Errorf("IDGenerator.PeekIDs() error = %v", err)
+				return
+			}
+			state := s.String()
+			wantState := tt.wantState.String()
+			if state != wantState {
+				t.Errorf("IDGenerator.TakeIDsWithRetry() = %v, wantState %v", state, wantState)
+			}
+		})
+	}
+}
+
+func Test_idGenerator_AdaptiveBatchSize(t *testing.T) {
+	const category = "adaptive_uid"
+	tests := []struct {
+		name          string
+		drainDuration time.Duration
+		wantBatchSize uint64
+	}{
+		{
+			name:          "FIRST_LEASE",
+			wantBatchSize: 10,
+		},
+		{
+			name:          "BURST_GROW",
+			drainDuration: time.Millisecond,
+			wantBatchSize: 20,
+		},
+		{
+			name:          "BURST_GROW_AGAIN",
+			drainDuration: time.Millisecond,
+			wantBatchSize: 40,
+		},
+		{
+			name:          "BURST_GROW_TO_MAX",
+			drainDuration: time.Millisecond,
+			wantBatchSize: 50,
+		},
+		{
+			name:          "IDLE_SHRINK",
+			drainDuration: time.Minute,
+			wantBatchSize: 25,
+		},
+		{
+			name:          "IDLE_SHRINK_TO_MIN",
+			drainDuration: time.Minute,
+			wantBatchSize: 12,
+		},
+	}
+	idP := provider.NewMockIDProvider()
+	g := NewIDGenerator(idP)
+	now := time.Now()
+	g.now = func() time.Time {
+		return now
+	}
+	err := g.RegisterCategory(category, CategoryPolicy{
+		Adaptive:       true,
+		MinBatchSize:   10,
+		MaxBatchSize:   50,
+		TargetInterval: time.Second,
+	})
+	if err != nil {
+		t.Errorf("IDGenerator.RegisterCategory() error = %v", err)
+		return
+	}
+	if err := g.Initialize(category, 1); err != nil {
+		t.Errorf("IDGenerator.Initialize() error = %v", err)
+		return
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			now = now.Add(tt.drainDuration)
+			gotTakenIDs, err := g.TakeIDsWithRetry(category)
+			if err != nil {
+				t.Errorf("IDGenerator.TakeIDsWithRetry() error = %v", err)
+				return
+			}
+			if size := gotTakenIDs.GetSize(); size != tt.wantBatchSize {
+				t.Errorf("IDGenerator.TakeIDsWithRetry() size = %v, want %v", size, tt.wantBatchSize)
+			}
+			if size := g.BatchSize(category); size != tt.wantBatchSize {
+				t.Errorf("IDGenerator.BatchSize() = %v, want %v", size, tt.wantBatchSize)
+			}
+		})
+	}
+}
+
+// blockingIDProvider never acquires the lock until the context is done.
+type blockingIDProvider struct {
+	*provider.MockIDProvider
+}
+
+func (p blockingIDProvider) Lock(ctx context.Context, category string) (interface{}, error) {
+	<-ctx.Done()
+	return nil, ctx.Err()
+}
+
+func Test_idGenerator_Context(t *testing.T) {
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	tests := []struct {
+		name    string
+		ctx     func() (context.Context, context.CancelFunc)
+		wantErr error
+	}{
+		{
+			name: "CANCELED",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return canceled, func() {}
+			},
+			wantErr: context.Canceled,
+		},
+		{
+			name: "DEADLINE_EXCEEDED",
+			ctx: func() (context.Context, context.CancelFunc) {
+				return context.WithTimeout(context.Background(), 10*time.Millisecond)
+			},
+			wantErr: context.DeadlineExceeded,
+		},
+	}
+	idP := blockingIDProvider{provider.NewMockIDProvider()}
+	g := NewIDGenerator(idP)
+	if err := g.Initialize(OperationIdCategory, 1); err != nil {
+		t.Errorf("IDGenerator.Initialize() error = %v", err)
+		return
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			if _, err := g.TakeIDsWithRetryContext(ctx, OperationIdCategory); err != tt.wantErr {
+				t.Errorf("IDGenerator.TakeIDsWithRetryContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+		t.Run(tt.name+"_TAKE_ID", func(t *testing.T) {
+			ctx, cancel := tt.ctx()
+			defer cancel()
+			if _, err := g.TakeIDContext(ctx, OperationIdCategory); err != tt.wantErr {
+				t.Errorf("IDGenerator.TakeIDContext() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
@@ -1,9 +1,5 @@
 package id_generator
 
-import (
-	"errors"
-)
-
 type IDRange struct {
 	CurrentStartID uint64 `json:"currentStartID"`
 	EndID          uint64 `json:"endID"`
@@ -36,11 +32,11 @@ func (i *IDRange) getEndID() uint64 {
 
 func (i *IDRange) takeIDs(idRangeSize uint64) (IDRange, error) {
 	if i.readOnly {
-		return IDRange{}, errors.New("ID range is read only")
+		return IDRange{}, ErrReadOnly
 	}
 	size := i.getSize()
 	if size == 0 {
-		return IDRange{}, errors.New("can't take ID's, range is empty")
+		return IDRange{}, ErrExhausted
 	}
 	if idRangeSize > size {
 		idRangeSize = size
@@ -53,7 +49,7 @@ func (i *IDRange) takeIDs(idRangeSize uint64) (IDRange, error) {
 
 func (i *IDRange) takeID() (uint64, error) {
 	if i.readOnly {
-		return 0, errors.New("ID range is read only")
+		return 0, ErrReadOnly
 	}
 	currAt := i.CurrentStartID
 	i.CurrentStartID++
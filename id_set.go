@@ -5,11 +5,13 @@ import (
 	"errors"
 	"fmt"
 	"math"
+	"time"
 )
 
 type idSet struct {
-	Ranges   idRanges `json:"ranges"`
-	Category string   `json:"category"`
+	Ranges   idRanges         `json:"ranges"`
+	Category string           `json:"category"`
+	Leases   map[string]lease `json:"leases,omitempty"`
 	readOnly bool
 }
 
@@ -49,14 +51,14 @@ func (s *idSet) getSize() uint64 {
 
 func (s *idSet) takeIDs(setSize uint64) (idSet, error) {
 	if s.readOnly {
-		return idSet{}, errors.New("ID range is read only")
+		return idSet{}, ErrReadOnly
 	}
 	if setSize <= 0 {
 		return idSet{}, errors.New("ID data size must be greater than 0")
 	}
 	size := s.getSize()
 	if size == 0 {
-		return idSet{}, errors.New("can't take ID's, data is empty")
+		return idSet{}, ErrExhausted
 	}
 	if setSize > size {
 		setSize = size
@@ -86,11 +88,11 @@ func (s *idSet) takeIDs(setSize uint64) (idSet, error) {
 
 func (s *idSet) takeID() (uint64, error) {
 	if s.readOnly {
-		return 0, errors.New("ID range is read only")
+		return 0, ErrReadOnly
 	}
 	size := s.getSize()
 	if size == 0 {
-		return 0, errors.New("can't take ID's, data is empty")
+		return 0, ErrExhausted
 	}
 	firstRange := s.Ranges[0]
 	id, err := firstRange.takeID()
@@ -107,7 +109,7 @@ func (s *idSet) takeID() (uint64, error) {
 
 func (s *idSet) peekNextID() (uint64, error) {
 	if len(s.Ranges) == 0 {
-		return 0, errors.New("no more ID's remaining in data")
+		return 0, ErrExhausted
 	}
 	firstRange := s.Ranges[0]
 	return firstRange.CurrentStartID, nil
@@ -136,12 +138,12 @@ func (s *idSet) validateNoOverlap(pushedRange IDRange) error {
 	previousRange := s.Ranges.lower(pushedRange)
 	if previousRange != nil {
 		if previousRange.EndID > pushedRange.CurrentStartID {
-			return errors.New(fmt.Sprintf("pushed range %v overlaps with range %v in idSet %v", pushedRange, previousRange, s))
+			return fmt.Errorf("pushed range %v overlaps with range %v in idSet %v: %w", pushedRange, previousRange, s, ErrOverlap)
 		}
 	} else {
 		firstRange := s.Ranges[0]
 		if pushedRange.EndID >= firstRange.CurrentStartID {
-			return errors.New(fmt.Sprintf("pushed range %v overlaps with range %v in idSet %v", pushedRange, firstRange, s))
+			return fmt.Errorf("pushed range %v overlaps with range %v in idSet %v: %w", pushedRange, firstRange, s, ErrOverlap)
 		}
 	}
 	return nil
@@ -177,13 +179,13 @@ func (s *idSet) addIDRange(newRange IDRange) {
 
 func (s *idSet) pushIDs(pushedIDSet idSet) error {
 	if pushedIDSet.Category != s.Category {
-		return errors.New(fmt.Sprintf("can't push ID data %v to ID data %v, categories don't match\n", pushedIDSet, s))
+		return fmt.Errorf("can't push ID data %v to ID data %v: %w", pushedIDSet, s, ErrCategoryMismatch)
 	}
 	if pushedIDSet.readOnly {
-		return errors.New(fmt.Sprintf("data %v is readOnly\n", pushedIDSet))
+		return fmt.Errorf("can't push ID data %v: %w", pushedIDSet, ErrReadOnly)
 	}
 	if s.readOnly {
-		return errors.New(fmt.Sprintf("data %v is readOnly\n", s))
+		return fmt.Errorf("can't push to ID data %v: %w", s, ErrReadOnly)
 	}
 	for _, r := range pushedIDSet.Ranges {
 		if err := s.validateNoOverlap(r); err != nil {
@@ -209,3 +211,59 @@ func (s *idSet) removeRange(rmv IDRange) {
 		}
 	}
 }
+
+func (s *idSet) hasLease(owner string) bool {
+	_, ok := s.Leases[owner]
+	return ok
+}
+
+func (s *idSet) leaseRanges(owner string) idRanges {
+	l := s.Leases[owner]
+	ranges := make(idRanges, len(l.Ranges))
+	copy(ranges, l.Ranges)
+	return ranges
+}
+
+func (s *idSet) setLease(owner string, ranges idRanges, expiry time.Time) {
+	if s.Leases == nil {
+		s.Leases = make(map[string]lease)
+	}
+	s.Leases[owner] = lease{
+		Ranges: ranges,
+		Expiry: expiry.UnixNano(),
+	}
+}
+
+func (s *idSet) removeLease(owner string) {
+	delete(s.Leases, owner)
+	if len(s.Leases) == 0 {
+		s.Leases = nil
+	}
+}
+
+// reapLeases returns the ranges of leases that expired before now to the set,
+// except for the lease of the given owner. It returns the owners reaped.
+func (s *idSet) reapLeases(now time.Time, except string) ([]string, error) {
+	var reaped []string
+	for owner, l := range s.Leases {
+		if owner == except || l.Expiry > now.UnixNano() {
+			continue
+		}
+		if len(l.Ranges) > 0 {
+			if err := s.pushIDs(newIDSet(l.Ranges, s.Category, false)); err != nil {
+				return nil, err
+			}
+		}
+		reaped = append(reaped, owner)
+	}
+	for _, owner := range reaped {
+		s.removeLease(owner)
+	}
+	return reaped, nil
+}
+
+func (s *idSet) ranges() idRanges {
+	ranges := make(idRanges, len(s.Ranges))
+	copy(ranges, s.Ranges)
+	return ranges
+}
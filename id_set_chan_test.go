@@ -0,0 +1,173 @@
+package id_generator
+
+// chanIDSet is the original channel-based implementation of IDSet, where a
+// goroutine owns the set and serves every call. It is kept to benchmark
+// IDSet against and its goroutine only exits on Close.
+type chanIDSet struct {
+	getSizeCh     chan getSizeReq
+	takeIDsCh     chan takeIDsReq
+	takeIDCh      chan takeIDReq
+	pushIDsCh     chan pushIDsReq
+	setReadOnlyCh chan setReadOnlyReq
+	isReadOnlyCh  chan isReadOnlyReq
+	toStringCh    chan toStringReq
+	closeCh       chan struct{}
+}
+
+func newChanIDSet(ranges []IDRange, category string, readOnly bool) *chanIDSet {
+	idSet := chanIDSet{
+		getSizeCh:     make(chan getSizeReq),
+		takeIDsCh:     make(chan takeIDsReq),
+		takeIDCh:      make(chan takeIDReq),
+		pushIDsCh:     make(chan pushIDsReq),
+		setReadOnlyCh: make(chan setReadOnlyReq),
+		isReadOnlyCh:  make(chan isReadOnlyReq),
+		toStringCh:    make(chan toStringReq),
+		closeCh:       make(chan struct{}),
+	}
+	go idSet.idSetCache(ranges, category, readOnly)
+	return &idSet
+}
+
+func newChanSet(idR idSet) *chanIDSet {
+	return newChanIDSet(idR.Ranges, idR.Category, idR.readOnly)
+}
+
+func (id chanIDSet) GetSize() uint64 {
+	req := getSizeReq{
+		resp: make(chan uint64),
+	}
+	id.getSizeCh <- req
+	return <-req.resp
+}
+
+func (id chanIDSet) TakeIDs(idRangeSize uint64) (*chanIDSet, error) {
+	req := takeIDsReq{
+		size: idRangeSize,
+		resp: make(chan rangeRespErr),
+	}
+	id.takeIDsCh <- req
+	resp := <-req.resp
+	return newChanSet(resp.rang), resp.err
+}
+
+func (id chanIDSet) TakeID() (uint64, error) {
+	req := takeIDReq{
+		resp: make(chan idRespErr),
+	}
+	id.takeIDCh <- req
+	resp := <-req.resp
+	return resp.id, resp.err
+}
+
+func (id chanIDSet) PushIDsFromString(data string) error {
+	req := pushIDsReq{
+		data: data,
+		resp: make(chan error),
+	}
+	id.pushIDsCh <- req
+	return <-req.resp
+}
+
+func (id *chanIDSet) SetReadOnly(r bool) {
+	req := setReadOnlyReq{
+		readOnly: r,
+	}
+	id.setReadOnlyCh <- req
+}
+
+func (id chanIDSet) String() string {
+	req := toStringReq{
+		resp: make(chan string),
+	}
+	id.toStringCh <- req
+	return <-req.resp
+}
+
+func (id chanIDSet) IsReadOnly() bool {
+	req := isReadOnlyReq{
+		resp: make(chan bool),
+	}
+	id.isReadOnlyCh <- req
+	return <-req.resp
+}
+
+// Close stops the goroutine serving the set.
+func (id chanIDSet) Close() {
+	close(id.closeCh)
+}
+
+type rangeRespErr struct {
+	rang idSet
+	err  error
+}
+
+type idRespErr struct {
+	id  uint64
+	err error
+}
+
+type getSizeReq struct {
+	resp chan uint64
+}
+
+type takeIDsReq struct {
+	size uint64
+	resp chan rangeRespErr
+}
+
+type takeIDReq struct {
+	resp chan idRespErr
+}
+
+type pushIDsReq struct {
+	data string
+	resp chan error
+}
+
+type setReadOnlyReq struct {
+	readOnly bool
+}
+
+type isReadOnlyReq struct {
+	resp chan bool
+}
+
+type toStringReq struct {
+	resp chan string
+}
+
+func (id *chanIDSet) idSetCache(ranges []IDRange, category string, readOnly bool) {
+	rang := idSet{
+		Ranges:   ranges,
+		Category: category,
+		readOnly: readOnly,
+	}
+	for {
+		select {
+		case gs := <-id.getSizeCh:
+			gs.resp <- rang.getSize()
+		case tIDs := <-id.takeIDsCh:
+			rang, err := rang.takeIDs(tIDs.size)
+			tIDs.resp <- rangeRespErr{rang: rang, err: err}
+		case tID := <-id.takeIDCh:
+			id, err := rang.takeID()
+			tID.resp <- idRespErr{id: id, err: err}
+		case pIDs := <-id.pushIDsCh:
+			set, err := setFromString(pIDs.data)
+			if err != nil {
+				pIDs.resp <- err
+			} else {
+				pIDs.resp <- rang.pushIDs(set)
+			}
+		case ro := <-id.setReadOnlyCh:
+			rang.readOnly = ro.readOnly
+		case str := <-id.toStringCh:
+			str.resp <- rang.toString()
+		case iro := <-id.isReadOnlyCh:
+			iro.resp <- rang.readOnly
+		case <-id.closeCh:
+			return
+		}
+	}
+}
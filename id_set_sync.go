@@ -1,31 +1,28 @@
 package id_generator
 
+import (
+	"sync"
+	"time"
+)
+
+// IDSet is a thread-safe set of ID ranges. It holds no goroutine, Close only
+// releases the ranges and makes every subsequent modification fail.
 type IDSet struct {
-	getSizeCh     chan getSizeReq
-	takeIDsCh     chan takeIDsReq
-	takeIDCh      chan takeIDReq
-	pushIDsCh     chan pushIDsReq
-	setReadOnlyCh chan setReadOnlyReq
-	isReadOnlyCh  chan isReadOnlyReq
-	toStringCh    chan toStringReq
+	mu     sync.Mutex
+	set    idSet
+	closed bool
 }
 
 func NewIDSet(ranges []IDRange, category string, readOnly bool) *IDSet {
-	idSet := IDSet{
-		getSizeCh:     make(chan getSizeReq),
-		takeIDsCh:     make(chan takeIDsReq),
-		takeIDCh:      make(chan takeIDReq),
-		pushIDsCh:     make(chan pushIDsReq),
-		setReadOnlyCh: make(chan setReadOnlyReq),
-		isReadOnlyCh:  make(chan isReadOnlyReq),
-		toStringCh:    make(chan toStringReq),
+	return &IDSet{
+		set: newIDSet(ranges, category, readOnly),
 	}
-	go idSet.idSetCache(ranges, category, readOnly)
-	return &idSet
 }
 
 func NewSet(idR idSet) *IDSet {
-	return NewIDSet(idR.Ranges, idR.Category, idR.readOnly)
+	return &IDSet{
+		set: idR,
+	}
 }
 
 func IDSetFromString(jsn string) (*IDSet, error) {
@@ -36,134 +33,103 @@ func IDSetFromString(jsn string) (*IDSet, error) {
 	return NewSet(set), nil
 }
 
-func (id IDSet) GetSize() uint64 {
-	req := getSizeReq{
-		resp: make(chan uint64),
-	}
-	id.getSizeCh <- req
-	return <-req.resp
-}
-
-func (id IDSet) TakeIDs(idRangeSize uint64) (*IDSet, error) {
-	req := takeIDsReq{
-		size: idRangeSize,
-		resp: make(chan rangeRespErr),
-	}
-	id.takeIDsCh <- req
-	resp := <-req.resp
-	return NewSet(resp.rang), resp.err
-}
-
-func (id IDSet) TakeID() (uint64, error) {
-	req := takeIDReq{
-		resp: make(chan idRespErr),
-	}
-	id.takeIDCh <- req
-	resp := <-req.resp
-	return resp.id, resp.err
+func (id *IDSet) GetSize() uint64 {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	return id.set.getSize()
 }
 
-func (id IDSet) PushIDsFromString(data string) error {
-	req := pushIDsReq{
-		data: data,
-		resp: make(chan error),
+func (id *IDSet) TakeIDs(idRangeSize uint64) (*IDSet, error) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	if id.closed {
+		return NewSet(idSet{}), ErrSetClosed
 	}
-	id.pushIDsCh <- req
-	return <-req.resp
+	rang, err := id.set.takeIDs(idRangeSize)
+	return NewSet(rang), err
 }
 
-func (id *IDSet) SetReadOnly(r bool) {
-	req := setReadOnlyReq{
-		readOnly: r,
+func (id *IDSet) TakeID() (uint64, error) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	if id.closed {
+		return 0, ErrSetClosed
 	}
-	id.setReadOnlyCh <- req
+	return id.set.takeID()
 }
 
-func (id IDSet) String() string {
-	req := toStringReq{
-		resp: make(chan string),
+func (id *IDSet) PushIDsFromString(data string) error {
+	set, err := setFromString(data)
+	if err != nil {
+		return err
 	}
-	id.toStringCh <- req
-	return <-req.resp
-}
-
-func (id IDSet) IsReadOnly() bool {
-	req := isReadOnlyReq{
-		resp: make(chan bool),
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	if id.closed {
+		return ErrSetClosed
 	}
-	id.isReadOnlyCh <- req
-	return <-req.resp
+	return id.set.pushIDs(set)
 }
 
-type rangeRespErr struct {
-	rang idSet
-	err  error
+func (id *IDSet) SetReadOnly(r bool) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.set.readOnly = r
 }
 
-type idRespErr struct {
-	id  uint64
-	err error
+func (id *IDSet) String() string {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	return id.set.toString()
 }
 
-type getSizeReq struct {
-	resp chan uint64
+func (id *IDSet) IsReadOnly() bool {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	return id.set.readOnly
 }
 
-type takeIDsReq struct {
-	size uint64
-	resp chan rangeRespErr
+// Close releases the ranges held by the set. Any IDs left in it are dropped,
+// so push them back to the provider first if they should be reused.
+func (id *IDSet) Close() {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.closed = true
+	id.set.Ranges = nil
 }
 
-type takeIDReq struct {
-	resp chan idRespErr
+func (id *IDSet) ranges() idRanges {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	return id.set.ranges()
 }
 
-type pushIDsReq struct {
-	data string
-	resp chan error
+func (id *IDSet) hasLease(owner string) bool {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	return id.set.hasLease(owner)
 }
 
-type setReadOnlyReq struct {
-	readOnly bool
+func (id *IDSet) leaseRanges(owner string) idRanges {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	return id.set.leaseRanges(owner)
 }
 
-type isReadOnlyReq struct {
-	resp chan bool
+func (id *IDSet) setLease(owner string, ranges idRanges, expiry time.Time) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.set.setLease(owner, ranges, expiry)
 }
 
-type toStringReq struct {
-	resp chan string
+func (id *IDSet) removeLease(owner string) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	id.set.removeLease(owner)
 }
 
-func (id *IDSet) idSetCache(ranges []IDRange, category string, readOnly bool) {
-	rang := idSet{
-		Ranges:   ranges,
-		Category: category,
-		readOnly: readOnly,
-	}
-	for {
-		select {
-		case gs := <-id.getSizeCh:
-			gs.resp <- rang.getSize()
-		case tIDs := <-id.takeIDsCh:
-			rang, err := rang.takeIDs(tIDs.size)
-			tIDs.resp <- rangeRespErr{rang: rang, err: err}
-		case tID := <-id.takeIDCh:
-			id, err := rang.takeID()
-			tID.resp <- idRespErr{id: id, err: err}
-		case pIDs := <-id.pushIDsCh:
-			set, err := setFromString(pIDs.data)
-			if err != nil {
-				pIDs.resp <- err
-			} else {
-				pIDs.resp <- rang.pushIDs(set)
-			}
-		case ro := <-id.setReadOnlyCh:
-			rang.readOnly = ro.readOnly
-		case str := <-id.toStringCh:
-			str.resp <- rang.toString()
-		case iro := <-id.isReadOnlyCh:
-			iro.resp <- rang.readOnly
-		}
-	}
+func (id *IDSet) reapLeases(now time.Time, except string) ([]string, error) {
+	id.mu.Lock()
+	defer id.mu.Unlock()
+	return id.set.reapLeases(now, except)
 }
@@ -1,6 +1,7 @@
 package id_generator
 
 import (
+	"runtime"
 	"sync"
 	"testing"
 	"time"
@@ -244,3 +245,106 @@ func Test_IDSet_PushIDs(t *testing.T) {
 		t.Errorf("ERROR: size after = %v, \n\t\t\t\t\t\t\t want size  = %v", gotSize, wantSize)
 	}
 }
+
+func Test_IDSet_Close(t *testing.T) {
+	set := NewIDSet([]IDRange{
+		NewIDRange(1, 1000, false),
+	}, OperationIdCategory, false)
+	set.Close()
+	if _, err := set.TakeID(); err == nil {
+		t.Errorf("IDSet.TakeID() after Close() error = %v, wantErr %v", err, true)
+	}
+	if _, err := set.TakeIDs(10); err == nil {
+		t.Errorf("IDSet.TakeIDs() after Close() error = %v, wantErr %v", err, true)
+	}
+	pushed := NewIDSet([]IDRange{
+		NewIDRange(1001, 2000, false),
+	}, OperationIdCategory, false)
+	if err := set.PushIDsFromString(pushed.String()); err == nil {
+		t.Errorf("IDSet.PushIDsFromString() after Close() error = %v, wantErr %v", err, true)
+	}
+	if size := set.GetSize(); size != 0 {
+		t.Errorf("IDSet.GetSize() after Close() = %v, want %v", size, 0)
+	}
+}
+
+func Test_IDSet_NoGoroutineLeak(t *testing.T) {
+	before := runtime.NumGoroutine()
+	set := NewIDSet([]IDRange{
+		NewIDRange(1, 1000000, false),
+	}, OperationIdCategory, false)
+	for i := 0; i < 1000; i++ {
+		out, err := set.TakeIDs(10)
+		if err != nil {
+			t.Errorf("IDSet.TakeIDs() error = %v", err)
+			return
+		}
+		if _, err := IDSetFromString(out.String()); err != nil {
+			t.Errorf("IDSetFromString() error = %v", err)
+			return
+		}
+	}
+	if after := runtime.NumGoroutine(); after > before {
+		t.Errorf("runtime.NumGoroutine() = %v, want at most %v", after, before)
+	}
+}
+
+func Benchmark_IDSet_TakeID(b *testing.B) {
+	set := NewIDSet([]IDRange{
+		NewIDRange(1, defaultTotalSize, false),
+	}, OperationIdCategory, false)
+	defer set.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := set.TakeID(); err != nil {
+			b.Errorf("IDSet.TakeID() error = %v", err)
+			return
+		}
+	}
+}
+
+func Benchmark_chanIDSet_TakeID(b *testing.B) {
+	set := newChanIDSet([]IDRange{
+		NewIDRange(1, defaultTotalSize, false),
+	}, OperationIdCategory, false)
+	defer set.Close()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		if _, err := set.TakeID(); err != nil {
+			b.Errorf("chanIDSet.TakeID() error = %v", err)
+			return
+		}
+	}
+}
+
+func Benchmark_IDSet_TakeIDParallel(b *testing.B) {
+	set := NewIDSet([]IDRange{
+		NewIDRange(1, defaultTotalSize, false),
+	}, OperationIdCategory, false)
+	defer set.Close()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := set.TakeID(); err != nil {
+				b.Errorf("IDSet.TakeID() error = %v", err)
+				return
+			}
+		}
+	})
+}
+
+func Benchmark_chanIDSet_TakeIDParallel(b *testing.B) {
+	set := newChanIDSet([]IDRange{
+		NewIDRange(1, defaultTotalSize, false),
+	}, OperationIdCategory, false)
+	defer set.Close()
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		for pb.Next() {
+			if _, err := set.TakeID(); err != nil {
+				b.Errorf("chanIDSet.TakeID() error = %v", err)
+				return
+			}
+		}
+	})
+}
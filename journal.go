@@ -0,0 +1,248 @@
+package id_generator
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zale144/id-generator/logger"
+	"os"
+	"sync"
+)
+
+// JournalPolicy makes the IDs a generator holds locally survive a restart.
+// The generator appends the IDs it hasn't handed out yet to a file on disk
+// and, when the journal is enabled again after a restart, resumes consuming
+// them instead of leasing fresh blocks from the provider.
+type JournalPolicy struct {
+	// Path of the journal file. It is created if it doesn't exist.
+	Path string
+	// Checkpoint is the number of IDs the generator may hand out before it has
+	// to append a new record. IDs handed out are never part of a record, so at
+	// most Checkpoint IDs per category are lost on a crash.
+	Checkpoint uint64
+}
+
+func (p JournalPolicy) validate() error {
+	if p.Path == "" {
+		return errors.New("journal path must not be empty")
+	}
+	if p.Checkpoint == 0 {
+		return errors.New("journal checkpoint must be greater than 0")
+	}
+	return nil
+}
+
+// journalEntry lists the unused IDs of a category. Only the last entry of a
+// category is relevant.
+type journalEntry struct {
+	Category string   `json:"category"`
+	Ranges   idRanges `json:"ranges"`
+}
+
+type journal struct {
+	mu         sync.Mutex
+	file       *os.File
+	checkpoint uint64
+}
+
+// openJournal reads the last entry of every category from the file at path,
+// compacts the file to just those entries and opens it for appending.
+func openJournal(policy JournalPolicy, log logger.Logger) (*journal, map[string]idRanges, error) {
+	recovered, err := readJournal(policy.Path, log)
+	if err != nil {
+		return nil, nil, err
+	}
+	tmpPath := policy.Path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	for category, ranges := range recovered {
+		if err := writeJournalEntry(tmp, journalEntry{Category: category, Ranges: ranges}); err != nil {
+			tmp.Close()
+			return nil, nil, err
+		}
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return nil, nil, err
+	}
+	if err := tmp.Close(); err != nil {
+		return nil, nil, err
+	}
+	if err := os.Rename(tmpPath, policy.Path); err != nil {
+		return nil, nil, err
+	}
+	file, err := os.OpenFile(policy.Path, os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		return nil, nil, err
+	}
+	return &journal{
+		file:       file,
+		checkpoint: policy.Checkpoint,
+	}, recovered, nil
+}
+
+// readJournal returns the unused IDs of every category in the journal. A
+// record that can't be parsed, like one torn by a crash, is skipped.
+func readJournal(path string, log logger.Logger) (map[string]idRanges, error) {
+	recovered := make(map[string]idRanges)
+	file, err := os.Open(path)
+	if os.IsNotExist(err) {
+		return recovered, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		var entry journalEntry
+		if err := json.Unmarshal(scanner.Bytes(), &entry); err != nil {
+			log.Warn("skipping invalid journal record", logger.String("path", path), logger.Error(err))
+			continue
+		}
+		if len(entry.Ranges) == 0 {
+			delete(recovered, entry.Category)
+			continue
+		}
+		recovered[entry.Category] = entry.Ranges
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return recovered, nil
+}
+
+func writeJournalEntry(file *os.File, entry journalEntry) error {
+	bytes, err := json.Marshal(entry)
+	if err != nil {
+		return err
+	}
+	_, err = file.Write(append(bytes, '\n'))
+	return err
+}
+
+// write appends the unused IDs of the category and syncs the file.
+func (j *journal) write(category string, ranges idRanges) error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	if err := writeJournalEntry(j.file, journalEntry{Category: category, Ranges: ranges}); err != nil {
+		return err
+	}
+	return j.file.Sync()
+}
+
+func (j *journal) close() error {
+	j.mu.Lock()
+	defer j.mu.Unlock()
+	return j.file.Close()
+}
+
+// EnableJournal opens the journal and recovers the IDs it lists, which the
+// generator hands out before leasing new blocks. It must be called before any
+// IDs are taken. When leases are enabled as well, recovered IDs are only used
+// if the generator's lease on them is still in place, so the lease owner has
+// to stay the same across restarts.
+func (g *IDGenerator) EnableJournal(policy JournalPolicy) error {
+	if err := policy.validate(); err != nil {
+		return errors.New(fmt.Sprintf("invalid journal policy: %s", err))
+	}
+	g.workersMu.Lock()
+	defer g.workersMu.Unlock()
+	if g.closed {
+		return ErrGeneratorClosed
+	}
+	if g.journal != nil {
+		return errors.New("journal is already enabled")
+	}
+	if len(g.workers) > 0 {
+		return errors.New("journal must be enabled before any IDs are taken")
+	}
+	j, recovered, err := openJournal(policy, g.log())
+	if err != nil {
+		return errors.New(fmt.Sprintf("failed to open journal: %s", err))
+	}
+	g.journal = j
+	for category, ranges := range recovered {
+		w := newCategoryWorker(g, category)
+		w.idSet = NewIDSet(ranges, category, false)
+		w.recovered = true
+		g.workers[category] = w
+		go w.run()
+		g.log().Info("recovered IDs from journal",
+			logger.String("category", category),
+			logger.String("range", w.idSet.String()),
+			logger.Uint64("size", w.idSet.GetSize()))
+	}
+	return nil
+}
+
+func (g *IDGenerator) journalOf() *journal {
+	g.workersMu.Lock()
+	defer g.workersMu.Unlock()
+	return g.journal
+}
+
+// recover checks the IDs recovered from the journal before they are first
+// used. With leases enabled they are dropped if the lease on them is gone.
+func (w *categoryWorker) recover(ctx context.Context) error {
+	if !w.recovered {
+		return nil
+	}
+	if _, ok := w.gen.leasePolicy(); ok {
+		w.hasLease = true
+		if err := w.checkpoint(ctx); err != nil && !errors.Is(err, ErrLeaseLost) {
+			return err
+		}
+	}
+	w.recovered = false
+	return nil
+}
+
+// reserveJournal accounts for n IDs about to be handed out, which must
+// already be removed from the local sets. When they exceed the IDs reserved
+// by the last journal record a new record is appended first.
+func (w *categoryWorker) reserveJournal(n uint64) error {
+	j := w.gen.journalOf()
+	if j == nil {
+		return nil
+	}
+	if n <= w.journaled {
+		w.journaled -= n
+		return nil
+	}
+	if err := j.write(w.category, skipIDs(w.localRanges(), j.checkpoint)); err != nil {
+		return err
+	}
+	w.journaled = j.checkpoint
+	return nil
+}
+
+// journalLocal records the local IDs after they changed other than by being
+// handed out, keeping the IDs reserved by the last record out of it.
+func (w *categoryWorker) journalLocal() {
+	j := w.gen.journalOf()
+	if j == nil {
+		return
+	}
+	if err := j.write(w.category, skipIDs(w.localRanges(), w.journaled)); err != nil {
+		w.gen.log().Error("error writing journal", logger.String("category", w.category), logger.Error(err))
+	}
+}
+
+// journalReleased records that the category holds no local IDs anymore.
+func (w *categoryWorker) journalReleased() {
+	j := w.gen.journalOf()
+	if j == nil {
+		return
+	}
+	w.journaled = 0
+	if err := j.write(w.category, nil); err != nil {
+		w.gen.log().Error("error writing journal", logger.String("category", w.category), logger.Error(err))
+	}
+}
@@ -0,0 +1,294 @@
+package id_generator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zale144/id-generator/logger"
+	"time"
+)
+
+// LeasePolicy makes the IDs a generator holds locally recoverable after a
+// crash. The generator records the IDs it hasn't handed out yet as a lease in
+// the category's state and keeps renewing it. Once a lease expires, the next
+// generator that updates the category returns its IDs to the free set.
+type LeasePolicy struct {
+	// Owner identifies the generator instance and must be unique among the
+	// instances sharing a provider.
+	Owner string
+	// TTL is how long a lease stays valid without being renewed. Leases are
+	// renewed every TTL/3.
+	TTL time.Duration
+	// Checkpoint is the number of IDs the generator may hand out before it has
+	// to update its lease. IDs handed out are never part of the lease, so at
+	// most Checkpoint IDs are lost on a crash.
+	Checkpoint uint64
+}
+
+func (p LeasePolicy) validate() error {
+	if p.Owner == "" {
+		return errors.New("lease owner must not be empty")
+	}
+	if p.TTL <= 0 {
+		return errors.New("lease TTL must be greater than 0")
+	}
+	if p.Checkpoint == 0 {
+		return errors.New("lease checkpoint must be greater than 0")
+	}
+	return nil
+}
+
+type lease struct {
+	Ranges idRanges `json:"ranges"`
+	Expiry int64    `json:"expiry"`
+}
+
+// skipIDs returns the ranges without their first n IDs.
+func skipIDs(ranges idRanges, n uint64) idRanges {
+	var rest idRanges
+	for _, r := range ranges {
+		size := r.getSize()
+		if n >= size {
+			n -= size
+			continue
+		}
+		rest = append(rest, NewIDRange(r.CurrentStartID+n, r.EndID, false))
+		n = 0
+	}
+	return rest
+}
+
+// EnableLeases records the IDs the generator holds locally as a lease in the
+// provider and starts renewing it in the background until Close is called.
+// Only IDs taken through TakeID and TakeN are covered; a set returned by
+// TakeIDsWithRetry is treated as handed out as a whole.
+func (g *IDGenerator) EnableLeases(policy LeasePolicy) error {
+	if err := policy.validate(); err != nil {
+		return errors.New(fmt.Sprintf("invalid lease policy: %s", err))
+	}
+	g.workersMu.Lock()
+	defer g.workersMu.Unlock()
+	if g.closed {
+		return ErrGeneratorClosed
+	}
+	if g.leases != nil {
+		return errors.New("leases are already enabled")
+	}
+	g.leases = &policy
+	g.stopLeases = make(chan struct{})
+	go g.renewLeases(policy, g.stopLeases)
+	return nil
+}
+
+func (g *IDGenerator) leasePolicy() (LeasePolicy, bool) {
+	g.workersMu.Lock()
+	defer g.workersMu.Unlock()
+	if g.leases == nil {
+		return LeasePolicy{}, false
+	}
+	return *g.leases, true
+}
+
+func (g *IDGenerator) leaseOwner() string {
+	policy, _ := g.leasePolicy()
+	return policy.Owner
+}
+
+// reapLeases returns the IDs of expired leases held by other owners to the state.
+func (g *IDGenerator) reapLeases(category string, currIDs *IDSet) error {
+	reaped, err := currIDs.reapLeases(g.now(), g.leaseOwner())
+	if err != nil {
+		return err
+	}
+	for _, owner := range reaped {
+		g.log().Info("reclaimed expired lease", logger.String("category", category), logger.String("owner", owner))
+	}
+	return nil
+}
+
+// releaseLease removes the generator's lease from the state. If hasLease is
+// set and the lease is already gone, ErrLeaseLost is returned.
+func (g *IDGenerator) releaseLease(currIDs *IDSet, hasLease bool) error {
+	owner := g.leaseOwner()
+	if hasLease && !currIDs.hasLease(owner) {
+		return ErrLeaseLost
+	}
+	currIDs.removeLease(owner)
+	return nil
+}
+
+// writeLease replaces the generator's lease for the category with the given
+// unused ranges, or removes it if there are none.
+func (g *IDGenerator) writeLease(ctx context.Context, category string, policy LeasePolicy, unused idRanges, hasLease bool) error {
+	_, err := g.updateWithRetry(ctx, category, false, "failed to write lease", func(currIDs *IDSet) error {
+		if hasLease && !currIDs.hasLease(policy.Owner) {
+			return ErrLeaseLost
+		}
+		g.putLease(currIDs, policy, unused)
+		return nil
+	})
+	return err
+}
+
+// putLease sets the generator's lease in the state to the given ranges, or
+// removes it if there are none.
+func (g *IDGenerator) putLease(currIDs *IDSet, policy LeasePolicy, unused idRanges) {
+	if len(unused) == 0 {
+		currIDs.removeLease(policy.Owner)
+		return
+	}
+	currIDs.setLease(policy.Owner, unused, g.now().Add(policy.TTL))
+}
+
+// renewLeases renews the lease of every category every TTL/3 until stop is closed.
+func (g *IDGenerator) renewLeases(policy LeasePolicy, stop chan struct{}) {
+	interval := policy.TTL / 3
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-stop:
+			return
+		}
+		g.workersMu.Lock()
+		workers := make([]*categoryWorker, 0, len(g.workers))
+		for _, w := range g.workers {
+			workers = append(workers, w)
+		}
+		g.workersMu.Unlock()
+		for _, w := range workers {
+			ctx, cancel := context.WithTimeout(context.Background(), interval)
+			resp := w.exec(ctx, func(w *categoryWorker) idResp {
+				return idResp{err: w.renewLease(ctx)}
+			})
+			cancel()
+			if resp.err != nil {
+				g.log().Error("error renewing lease", logger.String("category", w.category), logger.Error(resp.err))
+			}
+		}
+	}
+}
+
+// localRanges returns the unused local IDs in the order they are handed out.
+func (w *categoryWorker) localRanges() idRanges {
+	var ranges idRanges
+	if w.idSet != nil && !w.exposed {
+		ranges = append(ranges, w.idSet.ranges()...)
+	}
+	if w.nextIDSet != nil {
+		ranges = append(ranges, w.nextIDSet.ranges()...)
+	}
+	return ranges
+}
+
+// reserveLease accounts for n IDs about to be handed out, which must already
+// be removed from the local sets. When they exceed the IDs reserved by the
+// last checkpoint the lease is updated first.
+func (w *categoryWorker) reserveLease(ctx context.Context, n uint64) error {
+	if _, ok := w.gen.leasePolicy(); !ok {
+		return nil
+	}
+	if n <= w.reserved {
+		w.reserved -= n
+		return nil
+	}
+	return w.checkpoint(ctx)
+}
+
+// checkpoint writes all local IDs except the next Checkpoint ones to the
+// lease, which the worker may then hand out without updating the lease.
+func (w *categoryWorker) checkpoint(ctx context.Context) error {
+	policy, ok := w.gen.leasePolicy()
+	if !ok {
+		return nil
+	}
+	// the lease written by a pending prefetch covers IDs not local yet
+	if err := w.awaitPrefetch(ctx); err != nil {
+		return err
+	}
+	unused := skipIDs(w.localRanges(), policy.Checkpoint)
+	err := w.gen.writeLease(ctx, w.category, policy, unused, w.hasLease)
+	if errors.Is(err, ErrLeaseLost) {
+		w.dropLocal()
+		return err
+	}
+	if err != nil {
+		return err
+	}
+	w.leaseWritten()
+	return nil
+}
+
+// leaseWritten updates the worker after a lease covering all local IDs
+// except the next Checkpoint ones was written.
+func (w *categoryWorker) leaseWritten() {
+	policy, ok := w.gen.leasePolicy()
+	if !ok {
+		return
+	}
+	local := w.localRanges()
+	w.hasLease = len(skipIDs(local, policy.Checkpoint)) > 0
+	// only IDs that are local can be handed out without updating the lease
+	set := newIDSet(local, w.category, false)
+	w.reserved = set.getSize()
+	if w.reserved > policy.Checkpoint {
+		w.reserved = policy.Checkpoint
+	}
+}
+
+// leaseBatch returns the update that makes the worker's lease cover a batch
+// in the same write the batch is taken from the state with, or nil if leases
+// are disabled. A batch that replaces the current set is followed by the
+// prefetched set, so the lease is rewritten as on a checkpoint. A prefetched
+// batch is handed out after the local sets and is appended to the lease. It
+// is built on the worker goroutine since the prefetch runs concurrently.
+func (w *categoryWorker) leaseBatch(prefetch, expose bool) func(currIDs, takenIDs *IDSet) error {
+	policy, ok := w.gen.leasePolicy()
+	if !ok {
+		return nil
+	}
+	hasLease := w.hasLease
+	var next idRanges
+	if !prefetch && w.nextIDSet != nil {
+		next = w.nextIDSet.ranges()
+	}
+	return func(currIDs, takenIDs *IDSet) error {
+		if hasLease && !currIDs.hasLease(policy.Owner) {
+			return ErrLeaseLost
+		}
+		if prefetch {
+			w.gen.putLease(currIDs, policy, append(currIDs.leaseRanges(policy.Owner), takenIDs.ranges()...))
+			return nil
+		}
+		var unused idRanges
+		if !expose {
+			unused = takenIDs.ranges()
+		}
+		w.gen.putLease(currIDs, policy, skipIDs(append(unused, next...), policy.Checkpoint))
+		return nil
+	}
+}
+
+func (w *categoryWorker) renewLease(ctx context.Context) error {
+	if !w.hasLease {
+		return nil
+	}
+	return w.checkpoint(ctx)
+}
+
+// dropLocal discards the local sets after their lease was reclaimed, since
+// the IDs in them may already be in use elsewhere.
+func (w *categoryWorker) dropLocal() {
+	w.gen.log().Warn("dropping local IDs, lease was reclaimed", logger.String("category", w.category))
+	if w.idSet != nil {
+		w.idSet.Close()
+	}
+	if w.nextIDSet != nil {
+		w.nextIDSet.Close()
+	}
+	w.idSet, w.nextIDSet = nil, nil
+	w.hasLease = false
+	w.reserved = 0
+	w.journalReleased()
+}
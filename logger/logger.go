@@ -0,0 +1,116 @@
+// Package logger defines the structured logger used by the ID generator and
+// its providers, with adapters for the standard log package and zap.
+package logger
+
+import (
+	"fmt"
+	"log"
+	"strings"
+)
+
+// Field is a key-value pair attached to a log message.
+type Field struct {
+	Key   string
+	Value interface{}
+}
+
+func String(key, value string) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Uint64(key string, value uint64) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Int(key string, value int) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Any(key string, value interface{}) Field {
+	return Field{Key: key, Value: value}
+}
+
+func Error(err error) Field {
+	return Field{Key: "error", Value: err}
+}
+
+// Logger is a leveled, structured logger.
+type Logger interface {
+	Debug(msg string, fields ...Field)
+	Info(msg string, fields ...Field)
+	Warn(msg string, fields ...Field)
+	Error(msg string, fields ...Field)
+}
+
+type nopLogger struct{}
+
+// NewNop returns a logger that discards everything.
+func NewNop() Logger {
+	return nopLogger{}
+}
+
+func (nopLogger) Debug(string, ...Field) {}
+func (nopLogger) Info(string, ...Field)  {}
+func (nopLogger) Warn(string, ...Field)  {}
+func (nopLogger) Error(string, ...Field) {}
+
+// Level is the severity of a log message.
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+type stdLogger struct {
+	level Level
+}
+
+// NewStd returns a logger that writes messages of level Info and above
+// through the standard log package as "LEVEL msg key=value ...". It is the
+// default logger.
+func NewStd() Logger {
+	return NewStdLevel(LevelInfo)
+}
+
+// NewStdLevel returns a logger like NewStd that writes messages of the given
+// level and above.
+func NewStdLevel(level Level) Logger {
+	return stdLogger{level: level}
+}
+
+func (l stdLogger) Debug(msg string, fields ...Field) {
+	l.print(LevelDebug, "DEBUG", msg, fields)
+}
+
+func (l stdLogger) Info(msg string, fields ...Field) {
+	l.print(LevelInfo, "INFO", msg, fields)
+}
+
+func (l stdLogger) Warn(msg string, fields ...Field) {
+	l.print(LevelWarn, "WARN", msg, fields)
+}
+
+func (l stdLogger) Error(msg string, fields ...Field) {
+	l.print(LevelError, "ERROR", msg, fields)
+}
+
+func (l stdLogger) print(level Level, name, msg string, fields []Field) {
+	if level < l.level {
+		return
+	}
+	printStd(name, msg, fields)
+}
+
+func printStd(level, msg string, fields []Field) {
+	var b strings.Builder
+	b.WriteString(level)
+	b.WriteString(" ")
+	b.WriteString(msg)
+	for _, f := range fields {
+		b.WriteString(fmt.Sprintf(" %s=%v", f.Key, f.Value))
+	}
+	log.Println(b.String())
+}
@@ -0,0 +1,40 @@
+package logger
+
+import "go.uber.org/zap"
+
+type zapLogger struct {
+	l *zap.Logger
+}
+
+// NewZap returns a logger that writes through l.
+func NewZap(l *zap.Logger) Logger {
+	return zapLogger{l: l}
+}
+
+func (z zapLogger) Debug(msg string, fields ...Field) {
+	z.l.Debug(msg, zapFields(fields)...)
+}
+
+func (z zapLogger) Info(msg string, fields ...Field) {
+	z.l.Info(msg, zapFields(fields)...)
+}
+
+func (z zapLogger) Warn(msg string, fields ...Field) {
+	z.l.Warn(msg, zapFields(fields)...)
+}
+
+func (z zapLogger) Error(msg string, fields ...Field) {
+	z.l.Error(msg, zapFields(fields)...)
+}
+
+func zapFields(fields []Field) []zap.Field {
+	zf := make([]zap.Field, 0, len(fields))
+	for _, f := range fields {
+		if err, ok := f.Value.(error); ok && f.Key == "error" {
+			zf = append(zf, zap.Error(err))
+			continue
+		}
+		zf = append(zf, zap.Any(f.Key, f.Value))
+	}
+	return zf
+}
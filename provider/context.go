@@ -0,0 +1,23 @@
+package provider
+
+import (
+	"context"
+)
+
+// withContext runs fn and returns ctx.Err() if the context is done before fn
+// completes. fn keeps running in the background until it returns.
+func withContext(ctx context.Context, fn func() error) error {
+	if err := ctx.Err(); err != nil {
+		return err
+	}
+	done := make(chan error, 1)
+	go func() {
+		done <- fn()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
@@ -0,0 +1,309 @@
+package provider
+
+import (
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/zale144/id-generator/errs"
+	"github.com/zale144/id-generator/logger"
+	clientv3 "go.etcd.io/etcd/client/v3"
+	"go.etcd.io/etcd/client/v3/concurrency"
+	"math"
+	"sync"
+	"time"
+)
+
+type EtcdIDProvider struct {
+	client     *clientv3.Client
+	keyPrefix  string
+	sessionTTL int
+	logger     logger.Logger
+	mu         sync.Mutex
+	// session holds the lease of the locks. It is replaced once it expires.
+	session *concurrency.Session
+	// local serializes the holders of a category's lock in this process,
+	// since a concurrency.Mutex is reentrant for its session.
+	local map[string]chan struct{}
+}
+
+// etcdLock is a lock held with EtcdIDProvider.Lock.
+type etcdLock struct {
+	mutex *concurrency.Mutex
+	local chan struct{}
+}
+
+// EtcdOptions configures an EtcdIDProvider.
+type EtcdOptions struct {
+	// Endpoints are the addresses of the cluster's members.
+	Endpoints []string
+	// DialTimeout bounds the time NewEtcdIDProviderWithOptions waits for the
+	// connection. It defaults to five seconds.
+	DialTimeout time.Duration
+	// Username and Password authenticate the client.
+	Username string
+	Password string
+	// TLSConfig enables TLS when set.
+	TLSConfig *tls.Config
+	// KeyPrefix is prepended to the keys of the categories and their locks
+	// and defaults to "/id-generator/".
+	KeyPrefix string
+	// SessionTTL is the time in seconds the locks of a provider that lost its
+	// connection are kept. It defaults to 60 seconds.
+	SessionTTL int
+}
+
+func (o EtcdOptions) validate() error {
+	if len(o.Endpoints) == 0 {
+		return errors.New("at least one endpoint is required")
+	}
+	if o.DialTimeout < 0 {
+		return errors.New("dial timeout must not be negative")
+	}
+	if o.SessionTTL < 0 {
+		return errors.New("session TTL must not be negative")
+	}
+	if o.Username == "" && o.Password != "" {
+		return errors.New("password is set without a username")
+	}
+	return nil
+}
+
+func NewEtcdIDProvider(endpoints []string, opts ...Option) (*EtcdIDProvider, error) {
+	return NewEtcdIDProviderWithOptions(EtcdOptions{
+		Endpoints: endpoints,
+	}, opts...)
+}
+
+func NewEtcdIDProviderWithOptions(eOpts EtcdOptions, opts ...Option) (*EtcdIDProvider, error) {
+	if err := eOpts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid etcd options: %w", err)
+	}
+	o := newOptions(opts)
+	dialTimeout := eOpts.DialTimeout
+	if dialTimeout == 0 {
+		dialTimeout = 5 * time.Second
+	}
+	keyPrefix := eOpts.KeyPrefix
+	if keyPrefix == "" {
+		keyPrefix = "/id-generator/"
+	}
+	sessionTTL := eOpts.SessionTTL
+	if sessionTTL == 0 {
+		sessionTTL = 60
+	}
+	client, err := clientv3.New(clientv3.Config{
+		Endpoints:   eOpts.Endpoints,
+		DialTimeout: dialTimeout,
+		Username:    eOpts.Username,
+		Password:    eOpts.Password,
+		TLS:         eOpts.TLSConfig,
+	})
+	if err != nil {
+		return nil, etcdError("connect", "", err)
+	}
+	r := &EtcdIDProvider{
+		client:     client,
+		keyPrefix:  keyPrefix,
+		sessionTTL: sessionTTL,
+		logger:     o.logger,
+		local:      make(map[string]chan struct{}),
+	}
+	// a cluster that can't be reached fails here rather than on first use
+	ctx, cancel := context.WithTimeout(context.Background(), dialTimeout)
+	defer cancel()
+	if _, err := client.Get(ctx, keyPrefix, clientv3.WithCountOnly()); err != nil {
+		client.Close()
+		return nil, etcdError("connect", "", err)
+	}
+	if _, err := r.lockSession(); err != nil {
+		client.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// Close revokes the lease of the locks and closes the connection.
+func (r *EtcdIDProvider) Close() {
+	r.mu.Lock()
+	if r.session != nil {
+		r.session.Close()
+	}
+	r.mu.Unlock()
+	r.client.Close()
+}
+
+// lockSession returns the session the locks are held in, creating a new one
+// if the previous one expired. The session is kept alive until Close.
+func (r *EtcdIDProvider) lockSession() (*concurrency.Session, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.session != nil {
+		select {
+		case <-r.session.Done():
+			r.logger.Warn("etcd session expired, locks held in it are released")
+		default:
+			return r.session, nil
+		}
+	}
+	session, err := concurrency.NewSession(r.client, concurrency.WithTTL(r.sessionTTL))
+	if err != nil {
+		return nil, etcdError("session", "", err)
+	}
+	r.session = session
+	return session, nil
+}
+
+func (r *EtcdIDProvider) key(category string) string {
+	return r.keyPrefix + category
+}
+
+// Initialize stores the initial state unless the category already has one.
+func (r *EtcdIDProvider) Initialize(ctx context.Context, initSetData string, category string) error {
+	if initSetData == "" {
+		return errors.New("no data provided")
+	}
+	key := r.key(category)
+	_, err := r.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.CreateRevision(key), "=", 0)).
+		Then(clientv3.OpPut(key, initSetData)).
+		Commit()
+	if err != nil {
+		return etcdError("initialize", category, err)
+	}
+	return nil
+}
+
+// GetData returns the state along with the ModRevision of its key as the
+// version. The ModRevision is the cluster's revision at the key's last write,
+// so unlike the key's own version it never repeats, even after the key is
+// deleted and created again. It grows with the writes to any key though, and
+// GetData fails once it no longer fits in an int32.
+func (r *EtcdIDProvider) GetData(ctx context.Context, category string) (string, int32, error) {
+	resp, err := r.client.Get(ctx, r.key(category))
+	if err != nil {
+		return "", -1, etcdError("get", category, err)
+	}
+	if len(resp.Kvs) == 0 {
+		return "", -1, &errs.ProviderError{Op: "get", Category: category, Kind: errs.ErrCategoryNotFound}
+	}
+	kv := resp.Kvs[0]
+	if kv.ModRevision > math.MaxInt32 {
+		return "", -1, &errs.ProviderError{Op: "get", Category: category, Err: fmt.Errorf("revision %d doesn't fit in a version", kv.ModRevision)}
+	}
+	return string(kv.Value), int32(kv.ModRevision), nil
+}
+
+// SetData stores the state if the ModRevision of its key matches version, or
+// in any case if version is -1.
+func (r *EtcdIDProvider) SetData(ctx context.Context, data, category string, version int32) error {
+	key := r.key(category)
+	if version == -1 {
+		if _, err := r.client.Put(ctx, key, data); err != nil {
+			return etcdError("set", category, err)
+		}
+		return nil
+	}
+	return r.compareAndSwap(ctx, "set", category, version, clientv3.OpPut(key, data))
+}
+
+// Delete deletes the state if the ModRevision of its key matches version, or
+// in any case if version is -1.
+func (r *EtcdIDProvider) Delete(ctx context.Context, category string, version int32) error {
+	key := r.key(category)
+	if version == -1 {
+		resp, err := r.client.Delete(ctx, key)
+		if err != nil {
+			return etcdError("delete", category, err)
+		}
+		if resp.Deleted == 0 {
+			return &errs.ProviderError{Op: "delete", Category: category, Kind: errs.ErrCategoryNotFound}
+		}
+		return nil
+	}
+	return r.compareAndSwap(ctx, "delete", category, version, clientv3.OpDelete(key))
+}
+
+// compareAndSwap runs op if the ModRevision of the category's key matches
+// version. A missing key has a ModRevision of 0, which no version matches.
+func (r *EtcdIDProvider) compareAndSwap(ctx context.Context, op, category string, version int32, then clientv3.Op) error {
+	key := r.key(category)
+	resp, err := r.client.Txn(ctx).
+		If(clientv3.Compare(clientv3.ModRevision(key), "=", int64(version))).
+		Then(then).
+		Else(clientv3.OpGet(key, clientv3.WithCountOnly())).
+		Commit()
+	if err != nil {
+		return etcdError(op, category, err)
+	}
+	if resp.Succeeded {
+		return nil
+	}
+	if resp.Responses[0].GetResponseRange().Count == 0 {
+		return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrCategoryNotFound}
+	}
+	return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrVersionConflict}
+}
+
+// Lock acquires the category's lock with a concurrency.Mutex under
+// <KeyPrefix>lock.<category>. The lock is released by Unlock or, since it is
+// bound to the provider's session, when the session's lease expires.
+func (r *EtcdIDProvider) Lock(ctx context.Context, category string) (interface{}, error) {
+	local := r.localLock(category)
+	select {
+	case local <- struct{}{}:
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	session, err := r.lockSession()
+	if err != nil {
+		<-local
+		return nil, err
+	}
+	mutex := concurrency.NewMutex(session, r.key("lock."+category))
+	if err := mutex.Lock(ctx); err != nil {
+		<-local
+		return nil, etcdError("lock", category, err)
+	}
+	return &etcdLock{mutex: mutex, local: local}, nil
+}
+
+func (r *EtcdIDProvider) Unlock(ctx context.Context, lck interface{}) error {
+	lock, ok := lck.(*etcdLock)
+	if !ok {
+		return &errs.ProviderError{Op: "unlock", Err: errors.New("not an etcd lock")}
+	}
+	defer func() {
+		<-lock.local
+	}()
+	if err := lock.mutex.Unlock(ctx); err != nil {
+		return etcdError("unlock", "", err)
+	}
+	return nil
+}
+
+// localLock returns the semaphore serializing the category's lock in this
+// process.
+func (r *EtcdIDProvider) localLock(category string) chan struct{} {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	local, ok := r.local[category]
+	if !ok {
+		local = make(chan struct{}, 1)
+		r.local[category] = local
+	}
+	return local
+}
+
+// etcdError wraps an error returned by the etcd client. Context errors are
+// returned as they are.
+func etcdError(op, category string, err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	pErr := &errs.ProviderError{Op: op, Category: category, Err: err}
+	if err == concurrency.ErrSessionExpired {
+		pErr.Kind = errs.ErrDisconnected
+	}
+	return pErr
+}
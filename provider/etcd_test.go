@@ -0,0 +1,111 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"github.com/zale144/id-generator/errs"
+	"go.etcd.io/etcd/server/v3/embed"
+	"net/url"
+	"testing"
+	"time"
+)
+
+// startEtcd launches an embedded etcd server and stops it when the test ends.
+func startEtcd(t *testing.T) string {
+	t.Helper()
+	cfg := embed.NewConfig()
+	cfg.Dir = t.TempDir()
+	cfg.LogLevel = "error"
+	clientURL, _ := url.Parse("http://127.0.0.1:0")
+	peerURL, _ := url.Parse("http://127.0.0.1:0")
+	cfg.ListenClientUrls = []url.URL{*clientURL}
+	cfg.ListenPeerUrls = []url.URL{*peerURL}
+	e, err := embed.StartEtcd(cfg)
+	if err != nil {
+		t.Fatalf("starting etcd: %v", err)
+	}
+	t.Cleanup(e.Close)
+	select {
+	case <-e.Server.ReadyNotify():
+	case <-time.After(30 * time.Second):
+		t.Fatal("timed out waiting for etcd")
+	}
+	return e.Clients[0].Addr().String()
+}
+
+func Test_EtcdIDProvider(t *testing.T) {
+	const category = "uid"
+	endpoint := startEtcd(t)
+	r, err := NewEtcdIDProviderWithOptions(EtcdOptions{
+		Endpoints: []string{endpoint},
+		KeyPrefix: "/test/",
+	})
+	if err != nil {
+		t.Fatalf("NewEtcdIDProviderWithOptions() error = %v", err)
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	// a category is only initialized once
+	if err := r.Initialize(ctx, "a", category); err != nil {
+		t.Fatalf("EtcdIDProvider.Initialize() error = %v", err)
+	}
+	if err := r.Initialize(ctx, "b", category); err != nil {
+		t.Fatalf("EtcdIDProvider.Initialize() error = %v", err)
+	}
+	data, version, err := r.GetData(ctx, category)
+	if err != nil || data != "a" {
+		t.Fatalf("EtcdIDProvider.GetData() = %v, %v, want a", data, err)
+	}
+
+	if err := r.SetData(ctx, "b", category, version); err != nil {
+		t.Errorf("EtcdIDProvider.SetData() error = %v", err)
+	}
+	if err := r.SetData(ctx, "c", category, version); !errors.Is(err, errs.ErrVersionConflict) {
+		t.Errorf("EtcdIDProvider.SetData() stale version error = %v, want %v", err, errs.ErrVersionConflict)
+	}
+	if err := r.SetData(ctx, "a", "missing", version); !errors.Is(err, errs.ErrCategoryNotFound) {
+		t.Errorf("EtcdIDProvider.SetData() missing category error = %v, want %v", err, errs.ErrCategoryNotFound)
+	}
+
+	// a category that was deleted and created again doesn't take the
+	// versions read before
+	_, version, err = r.GetData(ctx, category)
+	if err != nil {
+		t.Fatalf("EtcdIDProvider.GetData() error = %v", err)
+	}
+	if err := r.Delete(ctx, category, version); err != nil {
+		t.Fatalf("EtcdIDProvider.Delete() error = %v", err)
+	}
+	if err := r.Initialize(ctx, "a", category); err != nil {
+		t.Fatalf("EtcdIDProvider.Initialize() error = %v", err)
+	}
+	// as many writes as before the delete
+	if err := r.SetData(ctx, "b", category, -1); err != nil {
+		t.Fatalf("EtcdIDProvider.SetData() error = %v", err)
+	}
+	if err := r.SetData(ctx, "b", category, version); !errors.Is(err, errs.ErrVersionConflict) {
+		t.Errorf("EtcdIDProvider.SetData() version of the deleted key error = %v, want %v", err, errs.ErrVersionConflict)
+	}
+
+	// the lock is exclusive until released
+	lock, err := r.Lock(ctx, category)
+	if err != nil {
+		t.Fatalf("EtcdIDProvider.Lock() error = %v", err)
+	}
+	timeoutCtx, cancel := context.WithTimeout(ctx, 100*time.Millisecond)
+	defer cancel()
+	if _, err := r.Lock(timeoutCtx, category); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("EtcdIDProvider.Lock() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	if err := r.Unlock(ctx, lock); err != nil {
+		t.Errorf("EtcdIDProvider.Unlock() error = %v", err)
+	}
+
+	if err := r.Delete(ctx, category, -1); err != nil {
+		t.Errorf("EtcdIDProvider.Delete() error = %v", err)
+	}
+	if _, _, err := r.GetData(ctx, category); !errors.Is(err, errs.ErrCategoryNotFound) {
+		t.Errorf("EtcdIDProvider.GetData() error = %v, want %v", err, errs.ErrCategoryNotFound)
+	}
+}
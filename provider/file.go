@@ -0,0 +1,224 @@
+//go:build darwin || dragonfly || freebsd || illumos || linux || netbsd || openbsd || windows
+// +build darwin dragonfly freebsd illumos linux netbsd openbsd windows
+
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"github.com/zale144/id-generator/errs"
+	"github.com/zale144/id-generator/logger"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// FileIDProvider stores the state of the categories in a local JSON file, so
+// a generator needs no external infrastructure and keeps its state across
+// restarts. Writes replace the file atomically and are synced to disk. The
+// file and the category locks are guarded with flock, or LockFileEx on
+// Windows, so several processes on the same host can share the file. The
+// provider is only built on the platforms that have one of them.
+type FileIDProvider struct {
+	path   string
+	logger logger.Logger
+}
+
+// fileEntry is the state of a category in the file.
+type fileEntry struct {
+	Data    string `json:"data"`
+	Version int32  `json:"version"`
+}
+
+// flockPoll is how often a busy file lock is retried.
+const flockPoll = 10 * time.Millisecond
+
+func NewFileIDProvider(path string, opts ...Option) (*FileIDProvider, error) {
+	if path == "" {
+		return nil, errors.New("invalid file options: path must not be empty")
+	}
+	if info, err := os.Stat(filepath.Dir(path)); err != nil || !info.IsDir() {
+		return nil, fmt.Errorf("invalid file options: directory of '%s' doesn't exist", path)
+	}
+	o := newOptions(opts)
+	return &FileIDProvider{
+		path:   path,
+		logger: o.logger,
+	}, nil
+}
+
+func (r *FileIDProvider) Initialize(ctx context.Context, initSetData string, category string) error {
+	if initSetData == "" {
+		return errors.New("no data provided")
+	}
+	return r.withState(ctx, "initialize", func(state map[string]fileEntry) (bool, error) {
+		if _, ok := state[category]; ok {
+			return false, nil
+		}
+		state[category] = fileEntry{Data: initSetData}
+		return true, nil
+	})
+}
+
+func (r *FileIDProvider) GetData(ctx context.Context, category string) (string, int32, error) {
+	var entry fileEntry
+	var ok bool
+	err := r.withState(ctx, "get", func(state map[string]fileEntry) (bool, error) {
+		entry, ok = state[category]
+		return false, nil
+	})
+	if err != nil {
+		return "", -1, err
+	}
+	if !ok {
+		return "", -1, &errs.ProviderError{Op: "get", Category: category, Kind: errs.ErrCategoryNotFound}
+	}
+	return entry.Data, entry.Version, nil
+}
+
+// SetData stores the state if its version matches, or in any case if version
+// is -1.
+func (r *FileIDProvider) SetData(ctx context.Context, data, category string, version int32) error {
+	return r.withState(ctx, "set", func(state map[string]fileEntry) (bool, error) {
+		entry, ok := state[category]
+		if err := checkVersion("set", category, entry, ok, version); err != nil {
+			return false, err
+		}
+		next := int32(0)
+		if ok {
+			next = entry.Version + 1
+		}
+		state[category] = fileEntry{Data: data, Version: next}
+		return true, nil
+	})
+}
+
+// Delete deletes the state if its version matches, or in any case if version
+// is -1.
+func (r *FileIDProvider) Delete(ctx context.Context, category string, version int32) error {
+	return r.withState(ctx, "delete", func(state map[string]fileEntry) (bool, error) {
+		entry, ok := state[category]
+		if !ok {
+			return false, &errs.ProviderError{Op: "delete", Category: category, Kind: errs.ErrCategoryNotFound}
+		}
+		if err := checkVersion("delete", category, entry, ok, version); err != nil {
+			return false, err
+		}
+		delete(state, category)
+		return true, nil
+	})
+}
+
+func checkVersion(op, category string, entry fileEntry, ok bool, version int32) error {
+	if version == -1 {
+		return nil
+	}
+	if !ok {
+		return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrCategoryNotFound}
+	}
+	if entry.Version != version {
+		return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrVersionConflict}
+	}
+	return nil
+}
+
+// withState runs fn on the state read from the file while holding the file's
+// lock and writes the state back if fn reports a change.
+func (r *FileIDProvider) withState(ctx context.Context, op string, fn func(state map[string]fileEntry) (bool, error)) error {
+	lock, err := flock(ctx, r.path+".lock")
+	if err != nil {
+		return fileError(op, "", err)
+	}
+	defer funlock(lock)
+
+	state, err := r.read()
+	if err != nil {
+		return fileError(op, "", err)
+	}
+	changed, err := fn(state)
+	if err != nil || !changed {
+		return err
+	}
+	if err := r.write(state); err != nil {
+		return fileError(op, "", err)
+	}
+	return nil
+}
+
+func (r *FileIDProvider) read() (map[string]fileEntry, error) {
+	state := make(map[string]fileEntry)
+	data, err := ioutil.ReadFile(r.path)
+	if os.IsNotExist(err) {
+		return state, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if len(data) == 0 {
+		return state, nil
+	}
+	if err := json.Unmarshal(data, &state); err != nil {
+		return nil, fmt.Errorf("reading '%s': %w", r.path, err)
+	}
+	return state, nil
+}
+
+// write replaces the file with the state through a synced temporary file, so
+// a crash leaves either the old or the new state.
+func (r *FileIDProvider) write(state map[string]fileEntry) error {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return err
+	}
+	tmpPath := r.path + ".tmp"
+	tmp, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0644)
+	if err != nil {
+		return err
+	}
+	if _, err := tmp.Write(data); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Sync(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	return replaceFile(tmpPath, r.path)
+}
+
+// Lock acquires the category's lock, an flock on a file next to the state
+// file. The lock is released by Unlock or when the process exits.
+func (r *FileIDProvider) Lock(ctx context.Context, category string) (interface{}, error) {
+	lock, err := flock(ctx, r.path+".lock."+url.PathEscape(category))
+	if err != nil {
+		return nil, fileError("lock", category, err)
+	}
+	return lock, nil
+}
+
+func (r *FileIDProvider) Unlock(ctx context.Context, lck interface{}) error {
+	lock, ok := lck.(*os.File)
+	if !ok {
+		return &errs.ProviderError{Op: "unlock", Err: errors.New("not a file lock")}
+	}
+	if err := funlock(lock); err != nil {
+		return fileError("unlock", "", err)
+	}
+	return nil
+}
+
+// fileError wraps an error from the file system. Context errors are returned
+// as they are.
+func fileError(op, category string, err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return &errs.ProviderError{Op: op, Category: category, Err: err}
+}
@@ -0,0 +1,63 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"golang.org/x/sys/windows"
+	"os"
+	"time"
+)
+
+// flock opens path and takes an exclusive LockFileEx lock on its first byte,
+// polling until the lock is free or the context is done. As with flock, locks
+// taken through different opens of the file exclude each other also within a
+// process.
+func flock(ctx context.Context, path string) (*os.File, error) {
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return nil, err
+	}
+	for {
+		err := windows.LockFileEx(windows.Handle(file.Fd()),
+			windows.LOCKFILE_EXCLUSIVE_LOCK|windows.LOCKFILE_FAIL_IMMEDIATELY, 0, 1, 0, new(windows.Overlapped))
+		if err == nil {
+			return file, nil
+		}
+		if !errors.Is(err, windows.ERROR_LOCK_VIOLATION) {
+			file.Close()
+			return nil, err
+		}
+		select {
+		case <-ctx.Done():
+			file.Close()
+			return nil, ctx.Err()
+		case <-time.After(flockPoll):
+		}
+	}
+}
+
+// funlock releases a lock taken with flock.
+func funlock(file *os.File) error {
+	err := windows.UnlockFileEx(windows.Handle(file.Fd()), 0, 1, 0, new(windows.Overlapped))
+	if cErr := file.Close(); err == nil {
+		err = cErr
+	}
+	return err
+}
+
+// replaceFile renames tmpPath to path. Directories can't be synced on
+// Windows, so the rename is written through to disk before it returns.
+func replaceFile(tmpPath, path string) error {
+	from, err := windows.UTF16PtrFromString(tmpPath)
+	if err != nil {
+		return err
+	}
+	to, err := windows.UTF16PtrFromString(path)
+	if err != nil {
+		return err
+	}
+	if err := windows.MoveFileEx(from, to, windows.MOVEFILE_REPLACE_EXISTING|windows.MOVEFILE_WRITE_THROUGH); err != nil {
+		return &os.LinkError{Op: "rename", Old: tmpPath, New: path, Err: err}
+	}
+	return nil
+}
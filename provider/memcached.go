@@ -0,0 +1,336 @@
+package provider
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"github.com/bradfitz/gomemcache/memcache"
+	"github.com/zale144/id-generator/errs"
+	"github.com/zale144/id-generator/logger"
+	"strconv"
+	"time"
+)
+
+// MemcachedIDProvider stores the state of the categories in memcached. Each
+// value holds the state along with a version, and writes go through gets and
+// cas so a version check and the write are atomic. Memcached may evict items
+// under memory pressure, so the servers must have room for the categories.
+type MemcachedIDProvider struct {
+	client     *memcache.Client
+	keyPrefix  string
+	lockExpiry int32
+	logger     logger.Logger
+}
+
+// MemcachedOptions configures a MemcachedIDProvider.
+type MemcachedOptions struct {
+	// Servers are the addresses of the servers the keys are spread over.
+	Servers []string
+	// Timeout bounds the network operations and defaults to 500
+	// milliseconds.
+	Timeout time.Duration
+	// MaxIdleConns is the maximum number of idle connections per server and
+	// defaults to 2.
+	MaxIdleConns int
+	// KeyPrefix is prepended to the keys of the categories and their locks.
+	KeyPrefix string
+	// LockExpiry releases the lock of a provider that didn't unlock it in
+	// time. It is rounded up to whole seconds and defaults to 30 seconds.
+	LockExpiry time.Duration
+}
+
+func (o MemcachedOptions) validate() error {
+	if len(o.Servers) == 0 {
+		return errors.New("at least one server is required")
+	}
+	if o.Timeout < 0 || o.LockExpiry < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if o.MaxIdleConns < 0 {
+		return errors.New("pool sizes must not be negative")
+	}
+	return nil
+}
+
+func NewMemcachedIDProvider(servers []string, opts ...Option) (*MemcachedIDProvider, error) {
+	return NewMemcachedIDProviderWithOptions(MemcachedOptions{
+		Servers: servers,
+	}, opts...)
+}
+
+func NewMemcachedIDProviderWithOptions(mOpts MemcachedOptions, opts ...Option) (*MemcachedIDProvider, error) {
+	if err := mOpts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid memcached options: %w", err)
+	}
+	o := newOptions(opts)
+	lockExpiry := mOpts.LockExpiry
+	if lockExpiry == 0 {
+		lockExpiry = 30 * time.Second
+	}
+	client := memcache.New(mOpts.Servers...)
+	client.Timeout = mOpts.Timeout
+	client.MaxIdleConns = mOpts.MaxIdleConns
+	// servers that can't be reached fail here rather than on first use
+	if err := client.Ping(); err != nil {
+		return nil, memcachedError("connect", "", err)
+	}
+	return &MemcachedIDProvider{
+		client:     client,
+		keyPrefix:  mOpts.KeyPrefix,
+		lockExpiry: int32((lockExpiry + time.Second - 1) / time.Second),
+		logger:     o.logger,
+	}, nil
+}
+
+// Close closes the idle connections.
+func (r *MemcachedIDProvider) Close() {
+	r.client.Close()
+}
+
+func (r *MemcachedIDProvider) key(category string) string {
+	return r.keyPrefix + category
+}
+
+// A value is the version in decimal, a newline and the serialized set.
+
+func encodeMemcached(data string, version int32) []byte {
+	return []byte(strconv.Itoa(int(version)) + "\n" + data)
+}
+
+func decodeMemcached(value []byte) (string, int32, error) {
+	i := bytes.IndexByte(value, '\n')
+	if i < 0 {
+		return "", -1, errors.New("invalid value")
+	}
+	version, err := strconv.ParseInt(string(value[:i]), 10, 32)
+	if err != nil {
+		return "", -1, fmt.Errorf("invalid version: %w", err)
+	}
+	return string(value[i+1:]), int32(version), nil
+}
+
+// Initialize stores the initial state unless the category already has one.
+func (r *MemcachedIDProvider) Initialize(ctx context.Context, initSetData string, category string) error {
+	if initSetData == "" {
+		return errors.New("no data provided")
+	}
+	err := withContext(ctx, func() error {
+		return r.client.Add(&memcache.Item{Key: r.key(category), Value: encodeMemcached(initSetData, 0)})
+	})
+	// another generator initialized the category first
+	if err != nil && err != memcache.ErrNotStored {
+		return memcachedError("initialize", category, err)
+	}
+	return nil
+}
+
+func (r *MemcachedIDProvider) GetData(ctx context.Context, category string) (string, int32, error) {
+	item, err := r.get(ctx, category)
+	if err != nil {
+		return "", -1, memcachedError("get", category, err)
+	}
+	data, version, err := decodeMemcached(item.Value)
+	if err != nil {
+		return "", -1, memcachedError("get", category, err)
+	}
+	return data, version, nil
+}
+
+func (r *MemcachedIDProvider) get(ctx context.Context, category string) (*memcache.Item, error) {
+	var item *memcache.Item
+	err := withContext(ctx, func() error {
+		var err error
+		item, err = r.client.Get(r.key(category))
+		return err
+	})
+	return item, err
+}
+
+// SetData stores the state if its version matches, or in any case if version
+// is -1. A write with version -1 still increments the version of an existing
+// state, so writers that read the previous one conflict.
+func (r *MemcachedIDProvider) SetData(ctx context.Context, data, category string, version int32) error {
+	if version != -1 {
+		return r.compareAndSwap(ctx, "set", category, version, func(item *memcache.Item) {
+			item.Value = encodeMemcached(data, version+1)
+		})
+	}
+	for {
+		_, current, err := r.GetData(ctx, category)
+		if errors.Is(err, errs.ErrCategoryNotFound) {
+			err = withContext(ctx, func() error {
+				return r.client.Add(&memcache.Item{Key: r.key(category), Value: encodeMemcached(data, 0)})
+			})
+			// the category was created in the meantime
+			if err == memcache.ErrNotStored {
+				continue
+			}
+			if err != nil {
+				return memcachedError("set", category, err)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		err = r.compareAndSwap(ctx, "set", category, current, func(item *memcache.Item) {
+			item.Value = encodeMemcached(data, current+1)
+		})
+		// the state was changed or deleted in the meantime
+		if errors.Is(err, errs.ErrVersionConflict) || errors.Is(err, errs.ErrCategoryNotFound) {
+			continue
+		}
+		return err
+	}
+}
+
+// Delete deletes the state if its version matches, or in any case if version
+// is -1.
+func (r *MemcachedIDProvider) Delete(ctx context.Context, category string, version int32) error {
+	if version == -1 {
+		err := withContext(ctx, func() error {
+			return r.client.Delete(r.key(category))
+		})
+		if err != nil {
+			return memcachedError("delete", category, err)
+		}
+		return nil
+	}
+	// memcached can't delete by cas, so the item is swapped for one that has
+	// already expired
+	return r.compareAndSwap(ctx, "delete", category, version, func(item *memcache.Item) {
+		item.Value = nil
+		item.Expiration = -1
+	})
+}
+
+// compareAndSwap applies change to the category's item and stores it if
+// neither the version in the item nor its cas token changed in between.
+func (r *MemcachedIDProvider) compareAndSwap(ctx context.Context, op, category string, version int32, change func(item *memcache.Item)) error {
+	item, err := r.get(ctx, category)
+	if err != nil {
+		return memcachedError(op, category, err)
+	}
+	_, current, err := decodeMemcached(item.Value)
+	if err != nil {
+		return memcachedError(op, category, err)
+	}
+	if current != version {
+		return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrVersionConflict}
+	}
+	change(item)
+	err = withContext(ctx, func() error {
+		return r.client.CompareAndSwap(item)
+	})
+	if err != nil {
+		return memcachedError(op, category, err)
+	}
+	return nil
+}
+
+// memcachedLockPoll is how often a busy lock is retried.
+const memcachedLockPoll = 10 * time.Millisecond
+
+// memcachedLock is a lock held with MemcachedIDProvider.Lock.
+type memcachedLock struct {
+	key      string
+	token    []byte
+	category string
+}
+
+// Lock acquires the category's lock by adding the key lock.<category> with a
+// random token, polling while another holder has it. The key expires after
+// LockExpiry, so a holder that crashed doesn't keep the lock forever.
+func (r *MemcachedIDProvider) Lock(ctx context.Context, category string) (interface{}, error) {
+	token := make([]byte, 16)
+	if _, err := rand.Read(token); err != nil {
+		return nil, memcachedError("lock", category, err)
+	}
+	lock := &memcachedLock{
+		key:      r.key("lock." + category),
+		token:    []byte(hex.EncodeToString(token)),
+		category: category,
+	}
+	for {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		added := make(chan error, 1)
+		go func() {
+			added <- r.client.Add(&memcache.Item{Key: lock.key, Value: lock.token, Expiration: r.lockExpiry})
+		}()
+		var err error
+		select {
+		case err = <-added:
+		case <-ctx.Done():
+			// release the lock in case it is acquired after the caller gave up
+			go func() {
+				if err := <-added; err == nil {
+					r.logger.Debug("releasing lock acquired after cancellation", logger.String("category", category))
+					r.Unlock(context.Background(), lock)
+				}
+			}()
+			return nil, ctx.Err()
+		}
+		if err == nil {
+			return lock, nil
+		}
+		if err != memcache.ErrNotStored {
+			return nil, memcachedError("lock", category, err)
+		}
+		select {
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		case <-time.After(memcachedLockPoll):
+		}
+	}
+}
+
+// Unlock releases the lock unless it expired and was taken by another
+// holder in the meantime.
+func (r *MemcachedIDProvider) Unlock(ctx context.Context, lck interface{}) error {
+	lock, ok := lck.(*memcachedLock)
+	if !ok {
+		return &errs.ProviderError{Op: "unlock", Err: errors.New("not a memcached lock")}
+	}
+	err := withContext(ctx, func() error {
+		item, err := r.client.Get(lock.key)
+		if err != nil {
+			return err
+		}
+		if !bytes.Equal(item.Value, lock.token) {
+			return memcache.ErrCacheMiss
+		}
+		// swap the key for an expired one so a lock taken since the Get
+		// isn't deleted
+		item.Value = nil
+		item.Expiration = -1
+		return r.client.CompareAndSwap(item)
+	})
+	if err == memcache.ErrCacheMiss || err == memcache.ErrCASConflict {
+		return &errs.ProviderError{Op: "unlock", Category: lock.category, Err: errors.New("lock expired before it was released")}
+	}
+	if err != nil {
+		return memcachedError("unlock", lock.category, err)
+	}
+	return nil
+}
+
+// memcachedError maps an error returned by the memcached client to the errs
+// package. Context errors are returned as they are.
+func memcachedError(op, category string, err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	pErr := &errs.ProviderError{Op: op, Category: category, Err: err}
+	switch err {
+	case memcache.ErrCacheMiss:
+		pErr.Kind = errs.ErrCategoryNotFound
+	case memcache.ErrCASConflict:
+		pErr.Kind = errs.ErrVersionConflict
+	}
+	return pErr
+}
@@ -0,0 +1,203 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"github.com/zale144/id-generator/errs"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeMemcached is a memcached server that supports the commands of the
+// provider and can delay its replies to add.
+type fakeMemcached struct {
+	l        net.Listener
+	mu       sync.Mutex
+	items    map[string]fakeMemcachedItem
+	cas      uint64
+	addDelay time.Duration
+}
+
+type fakeMemcachedItem struct {
+	value []byte
+	cas   uint64
+}
+
+func newFakeMemcached(t *testing.T) *fakeMemcached {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	m := &fakeMemcached{l: l, items: make(map[string]fakeMemcachedItem)}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go m.serve(c)
+		}
+	}()
+	t.Cleanup(func() { l.Close() })
+	return m
+}
+
+func (m *fakeMemcached) setAddDelay(d time.Duration) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.addDelay = d
+}
+
+func (m *fakeMemcached) has(key string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	_, ok := m.items[key]
+	return ok
+}
+
+func (m *fakeMemcached) serve(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return
+		}
+		f := strings.Fields(line)
+		if len(f) == 0 {
+			continue
+		}
+		var value []byte
+		if f[0] == "add" || f[0] == "set" || f[0] == "cas" {
+			n, _ := strconv.Atoi(f[4])
+			value = make([]byte, n+2)
+			if _, err := io.ReadFull(r, value); err != nil {
+				return
+			}
+			value = value[:n]
+		}
+		if _, err := io.WriteString(c, m.handle(f, value)); err != nil {
+			return
+		}
+	}
+}
+
+func (m *fakeMemcached) handle(f []string, value []byte) string {
+	m.mu.Lock()
+	delay := m.addDelay
+	m.mu.Unlock()
+	if f[0] == "add" {
+		time.Sleep(delay)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	store := func() string {
+		m.cas++
+		if exp, _ := strconv.Atoi(f[3]); exp < 0 {
+			delete(m.items, f[1])
+		} else {
+			m.items[f[1]] = fakeMemcachedItem{value: value, cas: m.cas}
+		}
+		return "STORED\r\n"
+	}
+	if f[0] == "version" {
+		return "VERSION 1.6.0\r\n"
+	}
+	item, ok := m.items[f[1]]
+	switch f[0] {
+	case "get", "gets":
+		if !ok {
+			return "END\r\n"
+		}
+		return fmt.Sprintf("VALUE %s 0 %d %d\r\n%s\r\nEND\r\n", f[1], len(item.value), item.cas, item.value)
+	case "set":
+		return store()
+	case "add":
+		if ok {
+			return "NOT_STORED\r\n"
+		}
+		return store()
+	case "cas":
+		if !ok {
+			return "NOT_FOUND\r\n"
+		}
+		if cas, _ := strconv.ParseUint(f[5], 10, 64); cas != item.cas {
+			return "EXISTS\r\n"
+		}
+		return store()
+	}
+	return "ERROR\r\n"
+}
+
+func Test_MemcachedIDProvider_LockCanceled(t *testing.T) {
+	m := newFakeMemcached(t)
+	r, err := NewMemcachedIDProviderWithOptions(MemcachedOptions{
+		Servers: []string{m.l.Addr().String()},
+		Timeout: time.Second,
+	}, WithLogger(nil))
+	if err != nil {
+		t.Fatalf("NewMemcachedIDProviderWithOptions() error = %v", err)
+	}
+	defer r.Close()
+
+	// the lock is added after the caller gave up
+	m.setAddDelay(200 * time.Millisecond)
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := r.Lock(ctx, "uid"); err != context.DeadlineExceeded {
+		t.Fatalf("MemcachedIDProvider.Lock() error = %v, want %v", err, context.DeadlineExceeded)
+	}
+	m.setAddDelay(0)
+
+	// and released rather than kept until it expires
+	time.Sleep(300 * time.Millisecond)
+	if m.has("lock.uid") {
+		t.Errorf("lock acquired after cancellation wasn't released")
+	}
+	ctx, cancel = context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	lock, err := r.Lock(ctx, "uid")
+	if err != nil {
+		t.Fatalf("MemcachedIDProvider.Lock() error = %v", err)
+	}
+	if err := r.Unlock(ctx, lock); err != nil {
+		t.Errorf("MemcachedIDProvider.Unlock() error = %v", err)
+	}
+}
+
+func Test_MemcachedIDProvider_SetDataAnyVersion(t *testing.T) {
+	m := newFakeMemcached(t)
+	r, err := NewMemcachedIDProvider([]string{m.l.Addr().String()}, WithLogger(nil))
+	if err != nil {
+		t.Fatalf("NewMemcachedIDProvider() error = %v", err)
+	}
+	defer r.Close()
+	ctx := context.Background()
+
+	// a missing category starts at version 0
+	if err := r.SetData(ctx, "a", "uid", -1); err != nil {
+		t.Fatalf("MemcachedIDProvider.SetData() error = %v", err)
+	}
+	if data, version, err := r.GetData(ctx, "uid"); err != nil || data != "a" || version != 0 {
+		t.Fatalf("MemcachedIDProvider.GetData() = %v, %v, %v, want a, 0, <nil>", data, version, err)
+	}
+
+	// an existing one keeps its version growing
+	if err := r.SetData(ctx, "b", "uid", -1); err != nil {
+		t.Fatalf("MemcachedIDProvider.SetData() error = %v", err)
+	}
+	if data, version, err := r.GetData(ctx, "uid"); err != nil || data != "b" || version != 1 {
+		t.Fatalf("MemcachedIDProvider.GetData() = %v, %v, %v, want b, 1, <nil>", data, version, err)
+	}
+	if err := r.SetData(ctx, "c", "uid", 0); !errors.Is(err, errs.ErrVersionConflict) {
+		t.Errorf("MemcachedIDProvider.SetData() stale version error = %v, want %v", err, errs.ErrVersionConflict)
+	}
+}
@@ -1,30 +1,36 @@
 package provider
 
 import (
+	"context"
 	"errors"
+	"github.com/zale144/id-generator/errs"
+	"github.com/zale144/id-generator/logger"
 )
 
 type MockIDProvider struct {
 	getDataCh chan getDataReq
 	setDataCh chan setDataReq
 	delDataCh chan delDataReq
+	logger    logger.Logger
 }
 
-func NewMockIDProvider() *MockIDProvider {
+func NewMockIDProvider(opts ...Option) *MockIDProvider {
+	o := newOptions(opts)
 	provider := MockIDProvider{
 		getDataCh: make(chan getDataReq),
 		setDataCh: make(chan setDataReq),
 		delDataCh: make(chan delDataReq),
+		logger:    o.logger,
 	}
 	go provider.cache()
 	return &provider
 }
 
-func (mp *MockIDProvider) Initialize(initData string, category string) error {
+func (mp *MockIDProvider) Initialize(ctx context.Context, initData string, category string) error {
 	if initData == "" {
 		return errors.New("no data provided")
 	}
-	return mp.SetData(initData, category, 0)
+	return mp.SetData(ctx, initData, category, 0)
 }
 
 type dataItem struct {
@@ -32,43 +38,73 @@ type dataItem struct {
 	version int32
 }
 
-func (mp *MockIDProvider) GetData(category string) (string, int32, error) {
+func (mp *MockIDProvider) GetData(ctx context.Context, category string) (string, int32, error) {
 	req := getDataReq{
 		category: category,
-		resp:     make(chan dataItem),
+		resp:     make(chan dataItem, 1),
+	}
+	select {
+	case mp.getDataCh <- req:
+	case <-ctx.Done():
+		return "", -1, ctx.Err()
+	}
+	select {
+	case d := <-req.resp:
+		if d.raw == "" {
+			return "", -1, &errs.ProviderError{Op: "get", Category: category, Kind: errs.ErrCategoryNotFound}
+		}
+		return d.raw, d.version, nil
+	case <-ctx.Done():
+		return "", -1, ctx.Err()
 	}
-	mp.getDataCh <- req
-	d := <-req.resp
-	return d.raw, d.version, nil
 }
 
-func (mp *MockIDProvider) SetData(data, category string, version int32) error {
+func (mp *MockIDProvider) SetData(ctx context.Context, data, category string, version int32) error {
 	req := setDataReq{
 		data: dataItem{
 			raw:     data,
 			version: version,
 		},
 		category: category,
-		resp:     make(chan error),
+		resp:     make(chan error, 1),
+	}
+	select {
+	case mp.setDataCh <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.resp:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	mp.setDataCh <- req
-	return <-req.resp
 }
 
-func (mp *MockIDProvider) Delete(category string, version int32) error {
+func (mp *MockIDProvider) Delete(ctx context.Context, category string, version int32) error {
 	req := delDataReq{
 		category: category,
 		version:  version,
+		resp:     make(chan error, 1),
+	}
+	select {
+	case mp.delDataCh <- req:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-req.resp:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
 	}
-	mp.delDataCh <- req
-	return nil
 }
 
-func (mp *MockIDProvider) Lock(string) (interface{}, error) {
-	return nil, nil
+func (mp *MockIDProvider) Lock(ctx context.Context, category string) (interface{}, error) {
+	return nil, ctx.Err()
 }
 
-func (mp *MockIDProvider) Unlock(lck interface{}) error {
+func (mp *MockIDProvider) Unlock(ctx context.Context, lck interface{}) error {
 	return nil
 }
 
@@ -98,18 +134,23 @@ func (mp *MockIDProvider) cache() {
 		case sd := <-mp.setDataCh:
 			d := m[sd.category]
 			if d.version >= 0 && sd.data.version != d.version {
-				sd.resp <- errors.New("version doesn't match")
+				mp.logger.Debug("version doesn't match", logger.String("category", sd.category), logger.Int("version", int(sd.data.version)), logger.Int("currentVersion", int(d.version)))
+				sd.resp <- &errs.ProviderError{Op: "set", Category: sd.category, Kind: errs.ErrVersionConflict}
 			} else {
 				sd.data.version = sd.data.version + 1
 				m[sd.category] = sd.data
 				sd.resp <- nil
 			}
 		case d := <-mp.delDataCh:
-			if d.version >= 0 && d.version != d.version {
-				d.resp <- errors.New("version doesn't match")
+			item, ok := m[d.category]
+			if !ok {
+				d.resp <- &errs.ProviderError{Op: "delete", Category: d.category, Kind: errs.ErrCategoryNotFound}
+			} else if d.version >= 0 && d.version != item.version {
+				d.resp <- &errs.ProviderError{Op: "delete", Category: d.category, Kind: errs.ErrVersionConflict}
+			} else {
+				delete(m, d.category)
+				d.resp <- nil
 			}
-			delete(m, d.category)
-			d.resp <- nil
 		}
 	}
 }
@@ -0,0 +1,33 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"github.com/zale144/id-generator/errs"
+	"testing"
+)
+
+func Test_MockIDProvider_Delete(t *testing.T) {
+	const category = "mock_delete_uid"
+	ctx := context.Background()
+
+	p := NewMockIDProvider()
+	if err := p.Initialize(ctx, "data", category); err != nil {
+		t.Errorf("MockIDProvider.Initialize() error = %v", err)
+		return
+	}
+	_, version, err := p.GetData(ctx, category)
+	if err != nil {
+		t.Errorf("MockIDProvider.GetData() error = %v", err)
+		return
+	}
+	if err := p.Delete(ctx, category, version+1); !errors.Is(err, errs.ErrVersionConflict) {
+		t.Errorf("MockIDProvider.Delete() stale version error = %v, want %v", err, errs.ErrVersionConflict)
+	}
+	if err := p.Delete(ctx, category, version); err != nil {
+		t.Errorf("MockIDProvider.Delete() error = %v", err)
+	}
+	if err := p.Delete(ctx, category, -1); !errors.Is(err, errs.ErrCategoryNotFound) {
+		t.Errorf("MockIDProvider.Delete() deleted category error = %v, want %v", err, errs.ErrCategoryNotFound)
+	}
+}
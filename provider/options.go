@@ -0,0 +1,32 @@
+package provider
+
+import "github.com/zale144/id-generator/logger"
+
+// Option configures a provider.
+type Option func(*options)
+
+type options struct {
+	logger     logger.Logger
+	atomicTake bool
+}
+
+// WithLogger sets the logger the provider writes to. A nil logger discards
+// everything.
+func WithLogger(l logger.Logger) Option {
+	return func(o *options) {
+		if l == nil {
+			l = logger.NewNop()
+		}
+		o.logger = l
+	}
+}
+
+func newOptions(opts []Option) options {
+	o := options{
+		logger: logger.NewStd(),
+	}
+	for _, opt := range opts {
+		opt(&o)
+	}
+	return o
+}
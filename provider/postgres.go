@@ -0,0 +1,224 @@
+package provider
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"errors"
+	"fmt"
+	"github.com/zale144/id-generator/errs"
+	"github.com/zale144/id-generator/logger"
+	"regexp"
+)
+
+// PostgresIDProvider stores the state of the categories in a PostgreSQL
+// table with a version column that is incremented on every write. It works
+// with any database/sql driver for PostgreSQL, so the state can live in a
+// database the service already owns.
+type PostgresIDProvider struct {
+	db     *sql.DB
+	table  string
+	logger logger.Logger
+}
+
+// PostgresOptions configures a PostgresIDProvider.
+type PostgresOptions struct {
+	// DB is the database the table is in.
+	DB *sql.DB
+	// Table is the name of the table, optionally qualified with a schema. It
+	// defaults to "id_generator".
+	Table string
+	// CreateTable creates the table if it doesn't exist.
+	CreateTable bool
+}
+
+var tableName = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*(\.[A-Za-z_][A-Za-z0-9_]*)?$`)
+
+func (o PostgresOptions) validate() error {
+	if o.DB == nil {
+		return errors.New("database must not be nil")
+	}
+	// the table name is put into the statements as is
+	if o.Table != "" && !tableName.MatchString(o.Table) {
+		return errors.New("table must be a plain identifier, optionally qualified with a schema")
+	}
+	return nil
+}
+
+func NewPostgresIDProvider(db *sql.DB, opts ...Option) (*PostgresIDProvider, error) {
+	return NewPostgresIDProviderWithOptions(PostgresOptions{
+		DB:          db,
+		CreateTable: true,
+	}, opts...)
+}
+
+func NewPostgresIDProviderWithOptions(pOpts PostgresOptions, opts ...Option) (*PostgresIDProvider, error) {
+	if err := pOpts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid PostgreSQL options: %w", err)
+	}
+	o := newOptions(opts)
+	table := pOpts.Table
+	if table == "" {
+		table = "id_generator"
+	}
+	r := &PostgresIDProvider{
+		db:     pOpts.DB,
+		table:  table,
+		logger: o.logger,
+	}
+	if pOpts.CreateTable {
+		_, err := r.db.Exec(`CREATE TABLE IF NOT EXISTS ` + r.table + ` (
+	category TEXT PRIMARY KEY,
+	data TEXT NOT NULL,
+	version INTEGER NOT NULL
+)`)
+		if err != nil {
+			return nil, postgresError("create table", "", err)
+		}
+	}
+	return r, nil
+}
+
+// Initialize stores the initial state unless the category already has one.
+func (r *PostgresIDProvider) Initialize(ctx context.Context, initSetData string, category string) error {
+	if initSetData == "" {
+		return errors.New("no data provided")
+	}
+	_, err := r.db.ExecContext(ctx, `INSERT INTO `+r.table+` (category, data, version) VALUES ($1, $2, 0)
+ON CONFLICT (category) DO NOTHING`, category, initSetData)
+	if err != nil {
+		return postgresError("initialize", category, err)
+	}
+	return nil
+}
+
+func (r *PostgresIDProvider) GetData(ctx context.Context, category string) (string, int32, error) {
+	var data string
+	var version int32
+	err := r.db.QueryRowContext(ctx, `SELECT data, version FROM `+r.table+` WHERE category = $1`, category).
+		Scan(&data, &version)
+	if err == sql.ErrNoRows {
+		return "", -1, &errs.ProviderError{Op: "get", Category: category, Kind: errs.ErrCategoryNotFound}
+	}
+	if err != nil {
+		return "", -1, postgresError("get", category, err)
+	}
+	return data, version, nil
+}
+
+// SetData stores the state if its version matches, or in any case if version
+// is -1.
+func (r *PostgresIDProvider) SetData(ctx context.Context, data, category string, version int32) error {
+	if version == -1 {
+		_, err := r.db.ExecContext(ctx, `INSERT INTO `+r.table+` (category, data, version) VALUES ($1, $2, 0)
+ON CONFLICT (category) DO UPDATE SET data = EXCLUDED.data, version = `+r.table+`.version + 1`, category, data)
+		if err != nil {
+			return postgresError("set", category, err)
+		}
+		return nil
+	}
+	res, err := r.db.ExecContext(ctx, `UPDATE `+r.table+` SET data = $1, version = version + 1
+WHERE category = $2 AND version = $3`, data, category, version)
+	if err != nil {
+		return postgresError("set", category, err)
+	}
+	return r.checkAffected(ctx, "set", category, res)
+}
+
+// Delete deletes the state if its version matches, or in any case if version
+// is -1.
+func (r *PostgresIDProvider) Delete(ctx context.Context, category string, version int32) error {
+	var res sql.Result
+	var err error
+	if version == -1 {
+		res, err = r.db.ExecContext(ctx, `DELETE FROM `+r.table+` WHERE category = $1`, category)
+	} else {
+		res, err = r.db.ExecContext(ctx, `DELETE FROM `+r.table+` WHERE category = $1 AND version = $2`, category, version)
+	}
+	if err != nil {
+		return postgresError("delete", category, err)
+	}
+	return r.checkAffected(ctx, "delete", category, res)
+}
+
+// checkAffected tells a version conflict from a missing category when a
+// statement didn't affect a row.
+func (r *PostgresIDProvider) checkAffected(ctx context.Context, op, category string, res sql.Result) error {
+	n, err := res.RowsAffected()
+	if err != nil {
+		return postgresError(op, category, err)
+	}
+	if n > 0 {
+		return nil
+	}
+	var exists bool
+	err = r.db.QueryRowContext(ctx, `SELECT EXISTS (SELECT 1 FROM `+r.table+` WHERE category = $1)`, category).
+		Scan(&exists)
+	if err != nil {
+		return postgresError(op, category, err)
+	}
+	if !exists {
+		return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrCategoryNotFound}
+	}
+	return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrVersionConflict}
+}
+
+// postgresLock is a lock held with PostgresIDProvider.Lock.
+type postgresLock struct {
+	conn     *sql.Conn
+	category string
+}
+
+// Lock acquires a session-level advisory lock keyed by the table and the
+// category. The lock is held on a connection taken from the pool until
+// Unlock, and released by the server if that connection is lost.
+func (r *PostgresIDProvider) Lock(ctx context.Context, category string) (interface{}, error) {
+	conn, err := r.db.Conn(ctx)
+	if err != nil {
+		return nil, postgresError("lock", category, err)
+	}
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock(hashtext($1), hashtext($2))`, r.table, category)
+	if err != nil {
+		// the lock may have been granted after the call gave up
+		discardConn(conn)
+		return nil, postgresError("lock", category, err)
+	}
+	return &postgresLock{conn: conn, category: category}, nil
+}
+
+func (r *PostgresIDProvider) Unlock(ctx context.Context, lck interface{}) error {
+	lock, ok := lck.(*postgresLock)
+	if !ok {
+		return &errs.ProviderError{Op: "unlock", Err: errors.New("not a PostgreSQL lock")}
+	}
+	var unlocked bool
+	err := lock.conn.QueryRowContext(ctx, `SELECT pg_advisory_unlock(hashtext($1), hashtext($2))`, r.table, lock.category).
+		Scan(&unlocked)
+	if err != nil {
+		discardConn(lock.conn)
+		return postgresError("unlock", lock.category, err)
+	}
+	lock.conn.Close()
+	if !unlocked {
+		return &errs.ProviderError{Op: "unlock", Category: lock.category, Err: errors.New("lock was not held")}
+	}
+	return nil
+}
+
+// discardConn closes a connection that may still hold an advisory lock instead
+// of returning it to the pool, which makes the server release the lock.
+func discardConn(conn *sql.Conn) {
+	conn.Raw(func(interface{}) error {
+		return driver.ErrBadConn
+	})
+	conn.Close()
+}
+
+// postgresError wraps an error returned by the database. Context errors are
+// returned as they are.
+func postgresError(op, category string, err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return &errs.ProviderError{Op: op, Category: category, Err: err}
+}
@@ -1,114 +1,438 @@
 package provider
 
 import (
+	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"github.com/gomodule/redigo/redis"
+	"github.com/zale144/id-generator/errs"
+	"github.com/zale144/id-generator/logger"
 	"gopkg.in/redsync.v1"
 	"time"
 )
 
 type RedisIDProvider struct {
-	pool    *redis.Pool
-	redsync *redsync.Redsync
-}
-
-func NewRedisIDProvider(addr, pass string, db int) *RedisIDProvider {
-	pool := &redis.Pool{
-		MaxIdle:     3,
-		IdleTimeout: 240 * time.Second,
-		Dial: func() (redis.Conn, error) {
-			c, err := redis.Dial("tcp", addr)
-			if err != nil {
-				return nil, err
-			}
-			return c, err
-		},
-		TestOnBorrow: func(c redis.Conn, t time.Time) error {
-			_, err := c.Do("PING")
-			return err
-		},
+	pool      redisPool
+	redsync   *redsync.Redsync
+	keyPrefix string
+	// cluster is set in cluster mode, where the keys of a category carry a
+	// hash tag so they are stored in the same slot.
+	cluster bool
+	logger  logger.Logger
+	// atomicTake is set by WithAtomicTake.
+	atomicTake bool
+}
+
+// redisPool hands out connections, either to a single server or routed
+// across a cluster.
+type redisPool interface {
+	Get() redis.Conn
+}
+
+// RedisOptions configures a RedisIDProvider. Exactly one of Addr,
+// SentinelAddrs and ClusterAddrs must be set.
+type RedisOptions struct {
+	// Addr is the server's address as host:port.
+	Addr string
+	// SentinelAddrs are the addresses of the sentinels monitoring the master
+	// named MasterName. The master is looked up on every new connection, so
+	// the provider follows failovers.
+	SentinelAddrs []string
+	MasterName    string
+	// SentinelPassword authenticates the connections to the sentinels.
+	SentinelPassword string
+	// ClusterAddrs are the addresses of some nodes of a Redis Cluster, the
+	// others are discovered from them.
+	ClusterAddrs []string
+	// Username and Password authenticate the connections. Username is only
+	// needed for Redis 6 ACL users.
+	Username string
+	Password string
+	// DB is the index of the database the categories are stored in.
+	DB int
+	// TLSConfig enables TLS when set.
+	TLSConfig *tls.Config
+	// DialTimeout, ReadTimeout and WriteTimeout bound the network operations
+	// of a connection. Zero means no timeout.
+	DialTimeout  time.Duration
+	ReadTimeout  time.Duration
+	WriteTimeout time.Duration
+	// MaxIdle is the maximum number of idle connections in the pool and
+	// defaults to 3. MaxActive is the maximum number of connections open at
+	// once, zero means no limit. Callers wait for a free connection once the
+	// limit is reached.
+	MaxIdle   int
+	MaxActive int
+	// IdleTimeout closes connections that stayed idle for longer and defaults
+	// to 240 seconds.
+	IdleTimeout time.Duration
+	// KeyPrefix is prepended to the keys of the categories and their locks.
+	KeyPrefix string
+}
+
+func (o RedisOptions) validate() error {
+	modes := 0
+	for _, set := range []bool{o.Addr != "", len(o.SentinelAddrs) > 0, len(o.ClusterAddrs) > 0} {
+		if set {
+			modes++
+		}
+	}
+	if modes != 1 {
+		return errors.New("exactly one of address, sentinel addresses and cluster addresses must be set")
+	}
+	if len(o.SentinelAddrs) > 0 && o.MasterName == "" {
+		return errors.New("master name must be set with sentinel addresses")
+	}
+	if len(o.ClusterAddrs) > 0 && o.DB != 0 {
+		return errors.New("cluster mode only supports database 0")
+	}
+	if o.DB < 0 {
+		return errors.New("database index must not be negative")
+	}
+	if o.DialTimeout < 0 || o.ReadTimeout < 0 || o.WriteTimeout < 0 || o.IdleTimeout < 0 {
+		return errors.New("timeouts must not be negative")
+	}
+	if o.MaxIdle < 0 || o.MaxActive < 0 {
+		return errors.New("pool sizes must not be negative")
+	}
+	if o.Username != "" && o.Password == "" {
+		return errors.New("username is set without a password")
+	}
+	return nil
+}
+
+func (o RedisOptions) dialOptions() []redis.DialOption {
+	dialOpts := []redis.DialOption{
+		redis.DialConnectTimeout(o.DialTimeout),
+		redis.DialReadTimeout(o.ReadTimeout),
+		redis.DialWriteTimeout(o.WriteTimeout),
+		redis.DialDatabase(o.DB),
+	}
+	if o.Password != "" {
+		dialOpts = append(dialOpts, redis.DialPassword(o.Password))
 	}
+	if o.Username != "" {
+		dialOpts = append(dialOpts, redis.DialUsername(o.Username))
+	}
+	if o.TLSConfig != nil {
+		dialOpts = append(dialOpts, redis.DialUseTLS(true), redis.DialTLSConfig(o.TLSConfig))
+	}
+	return dialOpts
+}
+
+func NewRedisIDProvider(addr, pass string, db int, opts ...Option) *RedisIDProvider {
+	return newRedisIDProvider(RedisOptions{
+		Addr:     addr,
+		Password: pass,
+		DB:       db,
+	}, newOptions(opts))
+}
+
+func NewRedisIDProviderWithOptions(rOpts RedisOptions, opts ...Option) (*RedisIDProvider, error) {
+	if err := rOpts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid Redis options: %w", err)
+	}
+	return newRedisIDProvider(rOpts, newOptions(opts)), nil
+}
+
+func newRedisIDProvider(rOpts RedisOptions, o options) *RedisIDProvider {
+	maxIdle := rOpts.MaxIdle
+	if maxIdle == 0 {
+		maxIdle = 3
+	}
+	idleTimeout := rOpts.IdleTimeout
+	if idleTimeout == 0 {
+		idleTimeout = 240 * time.Second
+	}
+	dialOpts := rOpts.dialOptions()
+	newPool := func(addr string) *redis.Pool {
+		return &redis.Pool{
+			MaxIdle:     maxIdle,
+			MaxActive:   rOpts.MaxActive,
+			Wait:        rOpts.MaxActive > 0,
+			IdleTimeout: idleTimeout,
+			Dial: func() (redis.Conn, error) {
+				c, err := redis.Dial("tcp", addr, dialOpts...)
+				if err != nil {
+					return nil, err
+				}
+				return c, err
+			},
+			TestOnBorrow: func(c redis.Conn, t time.Time) error {
+				_, err := c.Do("PING")
+				return err
+			},
+		}
+	}
+
+	var pool redisPool
+	switch {
+	case len(rOpts.ClusterAddrs) > 0:
+		pool = newClusterPool(rOpts.ClusterAddrs, newPool)
+	case len(rOpts.SentinelAddrs) > 0:
+		pool = newSentinelPool(rOpts, newPool(""), o.logger)
+	default:
+		pool = newPool(rOpts.Addr)
+	}
+	// the locks are taken on the same authenticated pool as the data
 	pools := []redsync.Pool{pool}
 	provider := &RedisIDProvider{
-		pool:    pool,
-		redsync: redsync.New(pools),
+		pool:       pool,
+		redsync:    redsync.New(pools),
+		keyPrefix:  rOpts.KeyPrefix,
+		cluster:    len(rOpts.ClusterAddrs) > 0,
+		logger:     o.logger,
+		atomicTake: o.atomicTake,
 	}
 	return provider
 }
 
-func (r *RedisIDProvider) Initialize(initSetData string, category string) error {
+// key returns the key the category is stored at.
+func (r *RedisIDProvider) key(category string) string {
+	if r.cluster {
+		return r.keyPrefix + "{" + category + "}"
+	}
+	return r.keyPrefix + category
+}
+
+// lockKey returns the key of the category's lock, which is in the same
+// cluster slot as the category.
+func (r *RedisIDProvider) lockKey(category string) string {
+	if r.cluster {
+		return r.keyPrefix + "lock.{" + category + "}"
+	}
+	return r.key("lock." + category)
+}
+
+// Initialize stores the initial state unless the category already has one.
+func (r *RedisIDProvider) Initialize(ctx context.Context, initSetData string, category string) error {
 	if initSetData == "" {
 		return errors.New("no data provided")
 	}
-	return r.SetData(initSetData, category, -1)
+	_, err := r.exec(ctx, func(conn redis.Conn) (interface{}, error) {
+		return initScript.Do(conn, r.key(category), initSetData)
+	})
+	if err != nil {
+		return redisError("initialize", category, err)
+	}
+	return nil
+}
+
+// do runs a command on a pooled connection and returns ctx.Err() if the
+// context is done before the reply arrives. The connection is returned to
+// the pool once the command completes.
+func (r *RedisIDProvider) do(ctx context.Context, cmd string, args ...interface{}) (interface{}, error) {
+	return r.exec(ctx, func(conn redis.Conn) (interface{}, error) {
+		return conn.Do(cmd, args...)
+	})
 }
 
-func (r *RedisIDProvider) GetData(category string) (data string, v int32, err error) {
-	conn := r.pool.Get()
-	defer func() {
-		err = conn.Close()
+// exec runs fn on a pooled connection like do.
+func (r *RedisIDProvider) exec(ctx context.Context, fn func(conn redis.Conn) (interface{}, error)) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	done := make(chan redisResp, 1)
+	go func() {
+		conn := r.pool.Get()
+		reply, err := fn(conn)
+		if cErr := conn.Close(); err == nil {
+			err = cErr
+		}
+		done <- redisResp{reply: reply, err: err}
 	}()
-	var bytes []byte
-	bytes, err = redis.Bytes(conn.Do("GET", category))
+	select {
+	case resp := <-done:
+		return resp.reply, resp.err
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+type redisResp struct {
+	reply interface{}
+	err   error
+}
+
+// A category's state is stored as a hash with the serialized set in the data
+// field and a version that is incremented on every write. Keys written as
+// plain strings by earlier versions are read as version 0 and converted to a
+// hash on their next write.
+
+// getScript returns the data and version of the state, or nil if there is none.
+var getScript = redis.NewScript(1, `
+local t = redis.call('TYPE', KEYS[1]).ok
+if t == 'none' then
+	return false
+end
+if t == 'string' then
+	return {redis.call('GET', KEYS[1]), '0'}
+end
+return redis.call('HMGET', KEYS[1], 'data', 'version')
+`)
+
+// setScript writes the state if its version matches ARGV[2], or in any case
+// if ARGV[2] is -1. It returns 1 on success, 0 on a version conflict and -1
+// if a version was given but there is no state.
+var setScript = redis.NewScript(1, `
+local t = redis.call('TYPE', KEYS[1]).ok
+local v
+if t == 'string' then
+	v = '0'
+elseif t == 'hash' then
+	v = redis.call('HGET', KEYS[1], 'version')
+end
+if ARGV[2] ~= '-1' then
+	if not v then
+		return -1
+	end
+	if v ~= ARGV[2] then
+		return 0
+	end
+end
+local next = 0
+if v then
+	next = tonumber(v) + 1
+end
+if t == 'string' then
+	redis.call('DEL', KEYS[1])
+end
+redis.call('HMSET', KEYS[1], 'data', ARGV[1], 'version', next)
+return 1
+`)
+
+// initScript writes the initial state unless there is one. It returns 1 if
+// it was written and 0 if the category already has a state.
+var initScript = redis.NewScript(1, `
+if redis.call('EXISTS', KEYS[1]) == 1 then
+	return 0
+end
+redis.call('HMSET', KEYS[1], 'data', ARGV[1], 'version', 0)
+return 1
+`)
+
+// delScript deletes the state if its version matches ARGV[1], or in any case
+// if ARGV[1] is -1. It returns the same values as setScript.
+var delScript = redis.NewScript(1, `
+local t = redis.call('TYPE', KEYS[1]).ok
+if t == 'none' then
+	return -1
+end
+if ARGV[1] ~= '-1' then
+	local v = '0'
+	if t == 'hash' then
+		v = redis.call('HGET', KEYS[1], 'version')
+	end
+	if v ~= ARGV[1] then
+		return 0
+	end
+end
+redis.call('DEL', KEYS[1])
+return 1
+`)
+
+func (r *RedisIDProvider) GetData(ctx context.Context, category string) (string, int32, error) {
+	values, err := redis.Values(r.exec(ctx, func(conn redis.Conn) (interface{}, error) {
+		return getScript.Do(conn, r.key(category))
+	}))
+	if err == redis.ErrNil {
+		return "", -1, &errs.ProviderError{Op: "get", Category: category, Kind: errs.ErrCategoryNotFound}
+	}
 	if err != nil {
-		err = fmt.Errorf("error getting key %s: %v", category, err)
+		return "", -1, redisError("get", category, err)
 	}
-	data = string(bytes)
-	return
+	var data string
+	var version int32
+	if _, err := redis.Scan(values, &data, &version); err != nil {
+		return "", -1, redisError("get", category, err)
+	}
+	return data, version, nil
 }
 
-func (r *RedisIDProvider) SetData(data, category string, version int32) (err error) {
-	conn := r.pool.Get()
-	defer func() {
-		err = conn.Close()
-	}()
-	_, err = conn.Do("SET", category, data)
+func (r *RedisIDProvider) SetData(ctx context.Context, data, category string, version int32) error {
+	res, err := redis.Int(r.exec(ctx, func(conn redis.Conn) (interface{}, error) {
+		return setScript.Do(conn, r.key(category), data, version)
+	}))
 	if err != nil {
 		v := string(data)
 		if len(v) > 15 {
 			v = v[0:12] + "..."
 		}
-		return fmt.Errorf("error setting key %s to %s: %v", category, v, err)
+		return redisError("set", category, fmt.Errorf("setting value %s: %w", v, err))
 	}
-	return err
+	return casResult("set", category, res)
 }
 
-func (r *RedisIDProvider) Exists(key string) (e bool, err error) {
-	conn := r.pool.Get()
-	defer func() {
-		err = conn.Close()
-	}()
-	ok, err := redis.Bool(conn.Do("EXISTS", key))
+// casResult maps the result of setScript or delScript to an error.
+func casResult(op, category string, res int) error {
+	switch res {
+	case 0:
+		return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrVersionConflict}
+	case -1:
+		return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrCategoryNotFound}
+	}
+	return nil
+}
+
+func (r *RedisIDProvider) Exists(ctx context.Context, key string) (e bool, err error) {
+	ok, err := redis.Bool(r.do(ctx, "EXISTS", r.key(key)))
 	if err != nil {
-		return ok, fmt.Errorf("error checking if key %s exists: %v", key, err)
+		return ok, redisError("exists", key, err)
 	}
 	return ok, err
 }
 
-func (r *RedisIDProvider) Delete(category string, i int32) (err error) {
-	conn := r.pool.Get()
-	defer func() {
-		err = conn.Close()
-	}()
-	_, err = conn.Do("DEL", category)
-	return err
+func (r *RedisIDProvider) Delete(ctx context.Context, category string, version int32) error {
+	res, err := redis.Int(r.exec(ctx, func(conn redis.Conn) (interface{}, error) {
+		return delScript.Do(conn, r.key(category), version)
+	}))
+	if err != nil {
+		return redisError("delete", category, err)
+	}
+	return casResult("delete", category, res)
 }
 
-func (r *RedisIDProvider) Lock(category string) (interface{}, error) {
-	mutex := r.redsync.NewMutex("lock." + category)
-	err := mutex.Lock()
-	if err != nil {
-		return nil, err
+func (r *RedisIDProvider) Lock(ctx context.Context, category string) (interface{}, error) {
+	mutex := r.redsync.NewMutex(r.lockKey(category))
+	locked := make(chan error, 1)
+	go func() {
+		locked <- mutex.Lock()
+	}()
+	select {
+	case err := <-locked:
+		if err == redsync.ErrFailed {
+			return nil, &errs.ProviderError{Op: "lock", Category: category, Kind: errs.ErrLockTimeout, Err: err}
+		}
+		if err != nil {
+			return nil, redisError("lock", category, err)
+		}
+		return mutex, nil
+	case <-ctx.Done():
+		// release the lock in case it is acquired after the caller gave up
+		go func() {
+			if err := <-locked; err == nil {
+				r.logger.Debug("releasing lock acquired after cancellation", logger.String("category", category))
+				mutex.Unlock()
+			}
+		}()
+		return nil, ctx.Err()
 	}
-	return mutex, nil
 }
 
-func (r *RedisIDProvider) Unlock(lck interface{}) error {
+func (r *RedisIDProvider) Unlock(ctx context.Context, lck interface{}) error {
 	mutex := lck.(*redsync.Mutex)
-	u := mutex.Unlock()
-	if u {
-		return errors.New("could not unlock")
+	if !mutex.Unlock() {
+		return &errs.ProviderError{Op: "unlock", Err: errors.New("could not unlock")}
 	}
 	return nil
 }
+
+// redisError wraps an error returned by the Redis client. Context errors are
+// returned as they are.
+func redisError(op, category string, err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	return &errs.ProviderError{Op: op, Category: category, Err: err}
+}
@@ -0,0 +1,302 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+const (
+	clusterSlots = 16384
+	// clusterMaxRedirects bounds the MOVED and ASK redirects followed by a
+	// single command.
+	clusterMaxRedirects = 5
+)
+
+// clusterPool hands out connections that route every command to the node
+// serving the slot of its key, following the redirects of a Redis Cluster.
+// Only the commands the provider and its locks use are supported: commands
+// whose first argument is the key, scripts with a single key and commands
+// without keys.
+type clusterPool struct {
+	addrs    []string
+	newPool  func(addr string) *redis.Pool
+	mu       sync.Mutex
+	slots    [clusterSlots]string
+	pools    map[string]*redis.Pool
+	hasSlots bool
+}
+
+func newClusterPool(addrs []string, newPool func(addr string) *redis.Pool) *clusterPool {
+	return &clusterPool{
+		addrs:   addrs,
+		newPool: newPool,
+		pools:   make(map[string]*redis.Pool),
+	}
+}
+
+func (c *clusterPool) Get() redis.Conn {
+	return &clusterConn{cluster: c}
+}
+
+// nodePool returns the pool of the node at addr, creating it if needed.
+func (c *clusterPool) nodePool(addr string) *redis.Pool {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	p, ok := c.pools[addr]
+	if !ok {
+		p = c.newPool(addr)
+		c.pools[addr] = p
+	}
+	return p
+}
+
+// nodeFor returns the address of the node serving slot, loading the slot
+// map first if needed. A negative slot means any node.
+func (c *clusterPool) nodeFor(slot int) (string, error) {
+	c.mu.Lock()
+	hasSlots := c.hasSlots
+	c.mu.Unlock()
+	if !hasSlots {
+		if err := c.refresh(); err != nil {
+			return "", err
+		}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if slot < 0 {
+		return c.addrs[0], nil
+	}
+	addr := c.slots[slot]
+	if addr == "" {
+		return "", fmt.Errorf("no node serves slot %d", slot)
+	}
+	return addr, nil
+}
+
+// refresh loads the slot map from the first node that answers CLUSTER SLOTS
+// with a valid reply.
+func (c *clusterPool) refresh() error {
+	c.mu.Lock()
+	addrs := append([]string{}, c.addrs...)
+	for addr := range c.pools {
+		addrs = append(addrs, addr)
+	}
+	c.mu.Unlock()
+
+	var lastErr error
+	for _, addr := range addrs {
+		conn := c.nodePool(addr).Get()
+		reply, err := redis.Values(conn.Do("CLUSTER", "SLOTS"))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		slots, err := parseClusterSlots(addr, reply)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		c.mu.Lock()
+		c.slots = slots
+		c.hasSlots = true
+		c.mu.Unlock()
+		return nil
+	}
+	return fmt.Errorf("failed to load cluster slots: %w", lastErr)
+}
+
+// parseClusterSlots returns the slot map described by the CLUSTER SLOTS
+// reply of the node at addr.
+func parseClusterSlots(addr string, reply []interface{}) ([clusterSlots]string, error) {
+	var slots [clusterSlots]string
+	invalid := fmt.Errorf("invalid CLUSTER SLOTS reply from %s", addr)
+	for _, r := range reply {
+		slotRange, err := redis.Values(r, nil)
+		if err != nil || len(slotRange) < 3 {
+			return slots, invalid
+		}
+		start, err := redis.Int(slotRange[0], nil)
+		if err != nil {
+			return slots, invalid
+		}
+		end, err := redis.Int(slotRange[1], nil)
+		if err != nil {
+			return slots, invalid
+		}
+		master, err := redis.Values(slotRange[2], nil)
+		if err != nil || len(master) < 2 {
+			return slots, invalid
+		}
+		host, err := redis.String(master[0], nil)
+		if err != nil {
+			return slots, invalid
+		}
+		port, err := redis.Int(master[1], nil)
+		if err != nil {
+			return slots, invalid
+		}
+		if host == "" {
+			// the node doesn't know its own address
+			host, _, _ = net.SplitHostPort(addr)
+		}
+		node := net.JoinHostPort(host, strconv.Itoa(port))
+		for s := start; s <= end && s < clusterSlots; s++ {
+			slots[s] = node
+		}
+	}
+	return slots, nil
+}
+
+// stale makes the next command reload the slot map, after a node failed and
+// its slots may have been taken over by a replica.
+func (c *clusterPool) stale() {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.hasSlots = false
+}
+
+// moved records that slot is now served by addr.
+func (c *clusterPool) moved(slot int, addr string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.slots[slot] = addr
+}
+
+// clusterConn is the connection returned by clusterPool. Every command is
+// sent on a pooled connection to the node serving its key.
+type clusterConn struct {
+	cluster *clusterPool
+}
+
+func (c *clusterConn) Do(cmd string, args ...interface{}) (interface{}, error) {
+	if cmd == "" {
+		return nil, nil
+	}
+	slot, err := commandSlot(cmd, args)
+	if err != nil {
+		return nil, err
+	}
+	addr, err := c.cluster.nodeFor(slot)
+	if err != nil {
+		return nil, err
+	}
+	asking := false
+	for i := 0; ; i++ {
+		reply, err := c.doOn(addr, asking, cmd, args)
+		if err == nil {
+			return reply, nil
+		}
+		redirect, ok := err.(redis.Error)
+		if !ok {
+			// the command isn't retried since it may have been applied,
+			// but the next one is routed by a fresh slot map
+			c.cluster.stale()
+			return reply, err
+		}
+		if i == clusterMaxRedirects {
+			return reply, err
+		}
+		// redirects look like "MOVED 3999 127.0.0.1:6381"
+		fields := strings.Fields(string(redirect))
+		if len(fields) != 3 || (fields[0] != "MOVED" && fields[0] != "ASK") {
+			return reply, err
+		}
+		addr = fields[2]
+		asking = fields[0] == "ASK"
+		if fields[0] == "MOVED" {
+			if s, err := strconv.Atoi(fields[1]); err == nil && s >= 0 && s < clusterSlots {
+				c.cluster.moved(s, addr)
+			}
+		}
+	}
+}
+
+func (c *clusterConn) doOn(addr string, asking bool, cmd string, args []interface{}) (interface{}, error) {
+	conn := c.cluster.nodePool(addr).Get()
+	defer conn.Close()
+	if asking {
+		if _, err := conn.Do("ASKING"); err != nil {
+			return nil, err
+		}
+	}
+	return conn.Do(cmd, args...)
+}
+
+var errClusterPipeline = errors.New("pipelining is not supported in cluster mode")
+
+func (c *clusterConn) Send(string, ...interface{}) error {
+	return errClusterPipeline
+}
+
+func (c *clusterConn) Flush() error {
+	return errClusterPipeline
+}
+
+func (c *clusterConn) Receive() (interface{}, error) {
+	return nil, errClusterPipeline
+}
+
+func (c *clusterConn) Close() error {
+	return nil
+}
+
+func (c *clusterConn) Err() error {
+	return nil
+}
+
+// commandSlot returns the slot of the command's key, or -1 if it has none.
+func commandSlot(cmd string, args []interface{}) (int, error) {
+	var key interface{}
+	switch strings.ToUpper(cmd) {
+	case "PING", "SCRIPT", "CLUSTER", "INFO", "ROLE":
+		return -1, nil
+	case "EVAL", "EVALSHA":
+		if len(args) < 3 {
+			return -1, nil
+		}
+		key = args[2]
+	default:
+		if len(args) == 0 {
+			return -1, nil
+		}
+		key = args[0]
+	}
+	k, err := redis.String(key, nil)
+	if err != nil {
+		return -1, fmt.Errorf("invalid key for %s: %w", cmd, err)
+	}
+	return keySlot(k), nil
+}
+
+// keySlot returns the cluster slot of key, hashing only the part between the
+// first braces if there is one, as Redis Cluster does.
+func keySlot(key string) int {
+	if start := strings.IndexByte(key, '{'); start >= 0 {
+		if end := strings.IndexByte(key[start+1:], '}'); end > 0 {
+			key = key[start+1 : start+1+end]
+		}
+	}
+	return int(crc16(key) % clusterSlots)
+}
+
+// crc16 is the CRC-16/XMODEM checksum used by Redis Cluster.
+func crc16(s string) uint16 {
+	var crc uint16
+	for i := 0; i < len(s); i++ {
+		crc ^= uint16(s[i]) << 8
+		for j := 0; j < 8; j++ {
+			if crc&0x8000 != 0 {
+				crc = crc<<1 ^ 0x1021
+			} else {
+				crc <<= 1
+			}
+		}
+	}
+	return crc
+}
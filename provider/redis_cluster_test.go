@@ -0,0 +1,178 @@
+package provider
+
+import (
+	"bufio"
+	"github.com/gomodule/redigo/redis"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// fakeClusterNode is a node that answers CLUSTER SLOTS with slots and GET
+// with its own address.
+type fakeClusterNode struct {
+	l     net.Listener
+	mu    sync.Mutex
+	slots string
+	conns []net.Conn
+}
+
+func newFakeClusterNode(t *testing.T) *fakeClusterNode {
+	t.Helper()
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	n := &fakeClusterNode{l: l}
+	go n.serve()
+	t.Cleanup(n.stop)
+	return n
+}
+
+func (n *fakeClusterNode) addr() string {
+	return n.l.Addr().String()
+}
+
+// serveSlots makes the node claim all slots for owner.
+func (n *fakeClusterNode) serveSlots(owner *fakeClusterNode) {
+	host, port, _ := net.SplitHostPort(owner.addr())
+	n.setSlots("*1\r\n*3\r\n:0\r\n:16383\r\n*2\r\n$" + strconv.Itoa(len(host)) + "\r\n" + host + "\r\n:" + port + "\r\n")
+}
+
+func (n *fakeClusterNode) setSlots(reply string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	n.slots = reply
+}
+
+func (n *fakeClusterNode) serve() {
+	for {
+		c, err := n.l.Accept()
+		if err != nil {
+			return
+		}
+		n.mu.Lock()
+		n.conns = append(n.conns, c)
+		n.mu.Unlock()
+		go n.handle(c)
+	}
+}
+
+func (n *fakeClusterNode) handle(c net.Conn) {
+	defer c.Close()
+	r := bufio.NewReader(c)
+	for {
+		cmd, err := readRedisCommand(r)
+		if err != nil {
+			return
+		}
+		var reply string
+		switch strings.ToUpper(cmd[0]) {
+		case "CLUSTER":
+			n.mu.Lock()
+			reply = n.slots
+			n.mu.Unlock()
+		case "GET":
+			reply = "$" + strconv.Itoa(len(n.addr())) + "\r\n" + n.addr() + "\r\n"
+		default:
+			reply = "+PONG\r\n"
+		}
+		if _, err := c.Write([]byte(reply)); err != nil {
+			return
+		}
+	}
+}
+
+// stop closes the listener and the open connections of the node.
+func (n *fakeClusterNode) stop() {
+	n.l.Close()
+	n.mu.Lock()
+	defer n.mu.Unlock()
+	for _, c := range n.conns {
+		c.Close()
+	}
+}
+
+func newFakeClusterPool(addrs ...string) *clusterPool {
+	return newClusterPool(addrs, func(addr string) *redis.Pool {
+		return &redis.Pool{
+			MaxIdle: 1,
+			Dial: func() (redis.Conn, error) {
+				return redis.Dial("tcp", addr, redis.DialConnectTimeout(time.Second))
+			},
+		}
+	})
+}
+
+func Test_parseClusterSlots(t *testing.T) {
+	master := []interface{}{[]byte("127.0.0.1"), int64(7000)}
+	tests := []struct {
+		name    string
+		reply   []interface{}
+		wantErr bool
+	}{
+		{name: "valid", reply: []interface{}{[]interface{}{int64(0), int64(16383), master}}},
+		{name: "missing master", reply: []interface{}{[]interface{}{int64(0), int64(16383)}}, wantErr: true},
+		{name: "not a range", reply: []interface{}{[]byte("0-16383")}, wantErr: true},
+		{name: "invalid slot", reply: []interface{}{[]interface{}{[]byte("x"), int64(16383), master}}, wantErr: true},
+		{
+			name:    "invalid port",
+			reply:   []interface{}{[]interface{}{int64(0), int64(16383), []interface{}{[]byte("127.0.0.1"), []byte("x")}}},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			slots, err := parseClusterSlots("127.0.0.1:7001", tt.reply)
+			if (err != nil) != tt.wantErr {
+				t.Fatalf("parseClusterSlots() error = %v, wantErr %v", err, tt.wantErr)
+			}
+			if !tt.wantErr && (slots[0] != "127.0.0.1:7000" || slots[clusterSlots-1] != "127.0.0.1:7000") {
+				t.Errorf("parseClusterSlots() = [%v ... %v], want 127.0.0.1:7000", slots[0], slots[clusterSlots-1])
+			}
+		})
+	}
+}
+
+func Test_clusterPool_refreshInvalidReply(t *testing.T) {
+	broken, healthy := newFakeClusterNode(t), newFakeClusterNode(t)
+	broken.setSlots("*1\r\n$7\r\n0-16383\r\n")
+	healthy.serveSlots(healthy)
+
+	c := newFakeClusterPool(broken.addr(), healthy.addr())
+	if err := c.refresh(); err != nil {
+		t.Fatalf("clusterPool.refresh() error = %v", err)
+	}
+	if got, _ := c.nodeFor(0); got != healthy.addr() {
+		t.Errorf("clusterPool.nodeFor() = %v, want %v", got, healthy.addr())
+	}
+}
+
+func Test_clusterPool_failover(t *testing.T) {
+	master, replica := newFakeClusterNode(t), newFakeClusterNode(t)
+	master.serveSlots(master)
+	replica.serveSlots(master)
+
+	c := newFakeClusterPool(master.addr(), replica.addr())
+	get := func() (string, error) {
+		conn := c.Get()
+		defer conn.Close()
+		return redis.String(conn.Do("GET", "{uid}"))
+	}
+	if got, err := get(); err != nil || got != master.addr() {
+		t.Fatalf("GET = %v, %v, want %v", got, err, master.addr())
+	}
+
+	// the replica takes over the slots of the failed master
+	master.stop()
+	replica.serveSlots(replica)
+	if _, err := get(); err == nil {
+		t.Errorf("GET on the failed master error = nil")
+	}
+	if got, err := get(); err != nil || got != replica.addr() {
+		t.Errorf("GET after the failover = %v, %v, want %v", got, err, replica.addr())
+	}
+}
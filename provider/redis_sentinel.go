@@ -0,0 +1,93 @@
+package provider
+
+import (
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"github.com/zale144/id-generator/logger"
+	"net"
+	"time"
+)
+
+// sentinelMaster asks the sentinels in turn for the address of the current
+// master of the named group.
+func sentinelMaster(sentinels []string, name string, dialOpts []redis.DialOption) (string, error) {
+	var lastErr error
+	for _, addr := range sentinels {
+		conn, err := redis.Dial("tcp", addr, dialOpts...)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		reply, err := redis.Strings(conn.Do("SENTINEL", "get-master-addr-by-name", name))
+		conn.Close()
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		if len(reply) != 2 {
+			lastErr = fmt.Errorf("invalid master address reply from sentinel %s", addr)
+			continue
+		}
+		return net.JoinHostPort(reply[0], reply[1]), nil
+	}
+	return "", fmt.Errorf("no sentinel knows the master of '%s': %w", name, lastErr)
+}
+
+// checkMaster fails unless the connection is to a master. After a failover
+// the old master is demoted, so connections to it are dropped from the pool
+// and new ones are dialed to the master the sentinels promoted.
+func checkMaster(conn redis.Conn) error {
+	reply, err := redis.Values(conn.Do("ROLE"))
+	if err != nil {
+		return err
+	}
+	if len(reply) == 0 {
+		return errors.New("empty ROLE reply")
+	}
+	role, err := redis.String(reply[0], nil)
+	if err != nil {
+		return err
+	}
+	if role != "master" {
+		return fmt.Errorf("connected to a %s instead of the master", role)
+	}
+	return nil
+}
+
+// newSentinelPool makes pool dial the master the sentinels currently report
+// and drop connections to a server that is no longer the master.
+func newSentinelPool(rOpts RedisOptions, pool *redis.Pool, log logger.Logger) *redis.Pool {
+	dialOpts := rOpts.dialOptions()
+	sentinelOpts := []redis.DialOption{
+		redis.DialConnectTimeout(rOpts.DialTimeout),
+		redis.DialReadTimeout(rOpts.ReadTimeout),
+		redis.DialWriteTimeout(rOpts.WriteTimeout),
+	}
+	if rOpts.SentinelPassword != "" {
+		sentinelOpts = append(sentinelOpts, redis.DialPassword(rOpts.SentinelPassword))
+	}
+	if rOpts.TLSConfig != nil {
+		sentinelOpts = append(sentinelOpts, redis.DialUseTLS(true), redis.DialTLSConfig(rOpts.TLSConfig))
+	}
+	pool.Dial = func() (redis.Conn, error) {
+		addr, err := sentinelMaster(rOpts.SentinelAddrs, rOpts.MasterName, sentinelOpts)
+		if err != nil {
+			return nil, err
+		}
+		c, err := redis.Dial("tcp", addr, dialOpts...)
+		if err != nil {
+			return nil, err
+		}
+		if err := checkMaster(c); err != nil {
+			c.Close()
+			return nil, fmt.Errorf("dialing master %s: %w", addr, err)
+		}
+		log.Debug("connected to Redis master", logger.String("master", rOpts.MasterName), logger.String("addr", addr))
+		return c, nil
+	}
+	pool.TestOnBorrow = func(c redis.Conn, t time.Time) error {
+		return checkMaster(c)
+	}
+	return pool
+}
@@ -0,0 +1,195 @@
+package provider
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"github.com/gomodule/redigo/redis"
+	"github.com/zale144/id-generator/errs"
+)
+
+// takeScript takes up to ARGV[1] IDs from the front of the state's ranges in
+// a single step and bumps its version like setScript. It returns {1, ranges}
+// with the taken ranges as a JSON array, {0} if there are no IDs left and
+// {-1} if there is no state.
+//
+// Lua numbers are doubles and can't hold every uint64 ID, so the IDs are read
+// from the serialized state with string patterns and added and subtracted as
+// decimal strings. Everything in the state but the top-level ranges, like the
+// leases, is kept as is.
+var takeScript = redis.NewScript(1, `
+local function cmp(a, b)
+	if #a ~= #b then
+		return #a < #b and -1 or 1
+	end
+	if a == b then
+		return 0
+	end
+	return a < b and -1 or 1
+end
+
+local function add(a, b)
+	local res, carry = {}, 0
+	local i, j = #a, #b
+	while i > 0 or j > 0 or carry > 0 do
+		local d = carry
+		if i > 0 then
+			d = d + tonumber(a:sub(i, i))
+			i = i - 1
+		end
+		if j > 0 then
+			d = d + tonumber(b:sub(j, j))
+			j = j - 1
+		end
+		table.insert(res, 1, tostring(d % 10))
+		carry = math.floor(d / 10)
+	end
+	return table.concat(res)
+end
+
+-- sub returns a - b for a >= b
+local function sub(a, b)
+	local res, borrow = {}, 0
+	local i, j = #a, #b
+	while i > 0 do
+		local d = tonumber(a:sub(i, i)) - borrow
+		if j > 0 then
+			d = d - tonumber(b:sub(j, j))
+			j = j - 1
+		end
+		if d < 0 then
+			d = d + 10
+			borrow = 1
+		else
+			borrow = 0
+		end
+		table.insert(res, 1, tostring(d))
+		i = i - 1
+	end
+	local s = (table.concat(res):gsub('^0+', ''))
+	if s == '' then
+		s = '0'
+	end
+	return s
+end
+
+local function encode(ranges)
+	local parts = {}
+	for _, r in ipairs(ranges) do
+		table.insert(parts, '{"currentStartID":' .. r[1] .. ',"endID":' .. r[2] .. '}')
+	end
+	return '[' .. table.concat(parts, ',') .. ']'
+end
+
+local t = redis.call('TYPE', KEYS[1]).ok
+local data, version
+if t == 'none' then
+	return {-1}
+elseif t == 'string' then
+	data = redis.call('GET', KEYS[1])
+	version = 0
+else
+	local hv = redis.call('HMGET', KEYS[1], 'data', 'version')
+	data = hv[1]
+	version = tonumber(hv[2])
+end
+
+local _, prefixEnd = string.find(data, '"ranges":', 1, true)
+if not prefixEnd then
+	return redis.error_reply('invalid state for ' .. KEYS[1])
+end
+local listStart = prefixEnd + 1
+local listEnd
+local ranges = {}
+if data:sub(listStart, listStart + 3) == 'null' then
+	listEnd = listStart + 3
+else
+	listEnd = string.find(data, ']', listStart, true)
+	for s, e in string.gmatch(data:sub(listStart, listEnd), '"currentStartID":(%d+),"endID":(%d+)') do
+		table.insert(ranges, {s, e})
+	end
+end
+
+local remaining = ARGV[1]
+local taken = {}
+while remaining ~= '0' and #ranges > 0 do
+	local r = ranges[1]
+	local size = add(sub(r[2], r[1]), '1')
+	if cmp(size, remaining) <= 0 then
+		table.insert(taken, r)
+		table.remove(ranges, 1)
+		remaining = sub(remaining, size)
+	else
+		local next = add(r[1], remaining)
+		table.insert(taken, {r[1], sub(next, '1')})
+		r[1] = next
+		remaining = '0'
+	end
+end
+if #taken == 0 then
+	return {0}
+end
+
+local newData = data:sub(1, listStart - 1) .. encode(ranges) .. data:sub(listEnd + 1)
+if t == 'string' then
+	redis.call('DEL', KEYS[1])
+end
+redis.call('HMSET', KEYS[1], 'data', newData, 'version', version + 1)
+return {1, encode(taken)}
+`)
+
+// WithAtomicTake makes a RedisIDProvider take IDs with a single script run
+// on the server instead of the generator locking the category and updating
+// its state, so many generators can take IDs from a category concurrently.
+// Pushing IDs back still goes through the versioned update. Other providers
+// ignore it.
+func WithAtomicTake() Option {
+	return func(o *options) {
+		o.atomicTake = true
+	}
+}
+
+// AtomicTake reports whether the provider was created WithAtomicTake.
+func (r *RedisIDProvider) AtomicTake() bool {
+	return r.atomicTake
+}
+
+// TakeIDs takes up to size IDs from the front of the category's ranges and
+// returns them as a serialized ID set.
+func (r *RedisIDProvider) TakeIDs(ctx context.Context, category string, size uint64) (string, error) {
+	if size == 0 {
+		return "", errors.New("number of IDs to take must be greater than 0")
+	}
+	values, err := redis.Values(r.exec(ctx, func(conn redis.Conn) (interface{}, error) {
+		return takeScript.Do(conn, r.key(category), size)
+	}))
+	if err != nil {
+		return "", redisError("take", category, err)
+	}
+	var res int
+	values, err = redis.Scan(values, &res)
+	if err != nil {
+		return "", redisError("take", category, err)
+	}
+	switch res {
+	case 0:
+		return "", &errs.ProviderError{Op: "take", Category: category, Kind: errs.ErrExhausted}
+	case -1:
+		return "", &errs.ProviderError{Op: "take", Category: category, Kind: errs.ErrCategoryNotFound}
+	}
+	var ranges []byte
+	if _, err := redis.Scan(values, &ranges); err != nil {
+		return "", redisError("take", category, err)
+	}
+	set, err := json.Marshal(struct {
+		Ranges   json.RawMessage `json:"ranges"`
+		Category string          `json:"category"`
+	}{
+		Ranges:   ranges,
+		Category: category,
+	})
+	if err != nil {
+		return "", err
+	}
+	return string(set), nil
+}
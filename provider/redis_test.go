@@ -0,0 +1,359 @@
+package provider
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"github.com/gomodule/redigo/redis"
+	"net"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func Test_RedisOptions_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		opts    RedisOptions
+		wantErr bool
+	}{
+		{name: "address", opts: RedisOptions{Addr: ":6379"}},
+		{name: "sentinel", opts: RedisOptions{SentinelAddrs: []string{":26379"}, MasterName: "idgen"}},
+		{name: "cluster", opts: RedisOptions{ClusterAddrs: []string{":7000"}}},
+		{name: "no address", opts: RedisOptions{}, wantErr: true},
+		{name: "two modes", opts: RedisOptions{Addr: ":6379", ClusterAddrs: []string{":7000"}}, wantErr: true},
+		{name: "sentinel without master", opts: RedisOptions{SentinelAddrs: []string{":26379"}}, wantErr: true},
+		{name: "cluster with database", opts: RedisOptions{ClusterAddrs: []string{":7000"}, DB: 1}, wantErr: true},
+		{name: "negative database", opts: RedisOptions{Addr: ":6379", DB: -1}, wantErr: true},
+		{name: "negative timeout", opts: RedisOptions{Addr: ":6379", ReadTimeout: -time.Second}, wantErr: true},
+		{name: "negative pool size", opts: RedisOptions{Addr: ":6379", MaxActive: -1}, wantErr: true},
+		{name: "username without password", opts: RedisOptions{Addr: ":6379", Username: "idgen"}, wantErr: true},
+		{name: "username and password", opts: RedisOptions{Addr: ":6379", Username: "idgen", Password: "secret"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.opts.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("RedisOptions.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// fakeRedisConn serves a connection with a fake server that replies OK to
+// every command, and returns the commands it received.
+func fakeRedisConn(t *testing.T, rOpts RedisOptions) ([][]string, error) {
+	t.Helper()
+	client, server := net.Pipe()
+	received := make(chan [][]string, 1)
+	go func() {
+		defer server.Close()
+		var cmds [][]string
+		defer func() { received <- cmds }()
+		r := bufio.NewReader(server)
+		for {
+			cmd, err := readRedisCommand(r)
+			if err != nil {
+				return
+			}
+			cmds = append(cmds, cmd)
+			if _, err := server.Write([]byte("+OK\r\n")); err != nil {
+				return
+			}
+		}
+	}()
+	dialOpts := append(rOpts.dialOptions(), redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+		return client, nil
+	}))
+	c, err := redis.Dial("tcp", "redis:6379", dialOpts...)
+	if err == nil {
+		c.Close()
+	} else {
+		client.Close()
+	}
+	return <-received, err
+}
+
+// readRedisCommand reads a command sent as an array of bulk strings.
+func readRedisCommand(r *bufio.Reader) ([]string, error) {
+	line, err := r.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(line, "*") {
+		return nil, fmt.Errorf("unexpected %q", line)
+	}
+	n, err := strconv.Atoi(strings.TrimSpace(line[1:]))
+	if err != nil {
+		return nil, err
+	}
+	cmd := make([]string, n)
+	for i := range cmd {
+		if _, err := r.ReadString('\n'); err != nil {
+			return nil, err
+		}
+		arg, err := r.ReadString('\n')
+		if err != nil {
+			return nil, err
+		}
+		cmd[i] = strings.TrimSuffix(arg, "\r\n")
+	}
+	return cmd, nil
+}
+
+func Test_RedisOptions_dialOptions(t *testing.T) {
+	tests := []struct {
+		name string
+		opts RedisOptions
+		want [][]string
+	}{
+		{name: "defaults", opts: RedisOptions{Addr: ":6379"}},
+		{
+			name: "password",
+			opts: RedisOptions{Addr: ":6379", Password: "secret"},
+			want: [][]string{{"AUTH", "secret"}},
+		},
+		{
+			name: "ACL user",
+			opts: RedisOptions{Addr: ":6379", Username: "idgen", Password: "secret"},
+			want: [][]string{{"AUTH", "idgen", "secret"}},
+		},
+		{
+			name: "database",
+			opts: RedisOptions{Addr: ":6379", DB: 3},
+			want: [][]string{{"SELECT", "3"}},
+		},
+		{
+			name: "password and database",
+			opts: RedisOptions{Addr: ":6379", Password: "secret", DB: 3},
+			want: [][]string{{"AUTH", "secret"}, {"SELECT", "3"}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := fakeRedisConn(t, tt.opts)
+			if err != nil {
+				t.Fatalf("redis.Dial() error = %v", err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("commands on dial = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_RedisOptions_dialOptionsTLS(t *testing.T) {
+	client, server := net.Pipe()
+	first := make(chan byte, 1)
+	go func() {
+		defer server.Close()
+		b := make([]byte, 1)
+		if _, err := server.Read(b); err == nil {
+			first <- b[0]
+		}
+		close(first)
+	}()
+	rOpts := RedisOptions{Addr: ":6379", TLSConfig: &tls.Config{ServerName: "redis"}, DialTimeout: time.Second}
+	dialOpts := append(rOpts.dialOptions(), redis.DialNetDial(func(network, addr string) (net.Conn, error) {
+		return client, nil
+	}))
+	if c, err := redis.Dial("tcp", "redis:6379", dialOpts...); err == nil {
+		c.Close()
+		t.Errorf("redis.Dial() without a TLS server succeeded")
+	}
+	// 0x16 starts the record of a TLS handshake
+	if b := <-first; b != 0x16 {
+		t.Errorf("first byte on dial = %#x, want a TLS handshake", b)
+	}
+}
+
+func Test_newRedisIDProvider_pool(t *testing.T) {
+	tests := []struct {
+		name            string
+		opts            RedisOptions
+		wantMaxIdle     int
+		wantMaxActive   int
+		wantWait        bool
+		wantIdleTimeout time.Duration
+	}{
+		{
+			name:            "defaults",
+			opts:            RedisOptions{Addr: ":6379"},
+			wantMaxIdle:     3,
+			wantIdleTimeout: 240 * time.Second,
+		},
+		{
+			name:            "limited",
+			opts:            RedisOptions{Addr: ":6379", MaxIdle: 5, MaxActive: 10, IdleTimeout: time.Minute},
+			wantMaxIdle:     5,
+			wantMaxActive:   10,
+			wantWait:        true,
+			wantIdleTimeout: time.Minute,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := newRedisIDProvider(tt.opts, newOptions([]Option{WithLogger(nil)}))
+			pool, ok := r.pool.(*redis.Pool)
+			if !ok {
+				t.Fatalf("RedisIDProvider.pool = %T, want *redis.Pool", r.pool)
+			}
+			if pool.MaxIdle != tt.wantMaxIdle || pool.MaxActive != tt.wantMaxActive ||
+				pool.Wait != tt.wantWait || pool.IdleTimeout != tt.wantIdleTimeout {
+				t.Errorf("pool = {MaxIdle: %d, MaxActive: %d, Wait: %v, IdleTimeout: %v}, want {%d, %d, %v, %v}",
+					pool.MaxIdle, pool.MaxActive, pool.Wait, pool.IdleTimeout,
+					tt.wantMaxIdle, tt.wantMaxActive, tt.wantWait, tt.wantIdleTimeout)
+			}
+		})
+	}
+}
+
+func Test_RedisIDProvider_key(t *testing.T) {
+	tests := []struct {
+		name        string
+		r           *RedisIDProvider
+		wantKey     string
+		wantLockKey string
+	}{
+		{name: "plain", r: &RedisIDProvider{}, wantKey: "uid", wantLockKey: "lock.uid"},
+		{name: "prefix", r: &RedisIDProvider{keyPrefix: "idgen:"}, wantKey: "idgen:uid", wantLockKey: "idgen:lock.uid"},
+		{name: "cluster", r: &RedisIDProvider{cluster: true}, wantKey: "{uid}", wantLockKey: "lock.{uid}"},
+		{
+			name:        "cluster with prefix",
+			r:           &RedisIDProvider{keyPrefix: "idgen:", cluster: true},
+			wantKey:     "idgen:{uid}",
+			wantLockKey: "idgen:lock.{uid}",
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.r.key("uid"); got != tt.wantKey {
+				t.Errorf("RedisIDProvider.key() = %v, want %v", got, tt.wantKey)
+			}
+			if got := tt.r.lockKey("uid"); got != tt.wantLockKey {
+				t.Errorf("RedisIDProvider.lockKey() = %v, want %v", got, tt.wantLockKey)
+			}
+		})
+	}
+}
+
+// redisServer returns the address of the Redis server the integration tests
+// run against, taken from REDIS_ADDR.
+func redisServer(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping this since Redis is not being used yet")
+	}
+	if addr := os.Getenv("REDIS_ADDR"); addr != "" {
+		return addr
+	}
+	return ":6379"
+}
+
+func newRedisTestProvider(t *testing.T, rOpts RedisOptions) *RedisIDProvider {
+	t.Helper()
+	r, err := NewRedisIDProviderWithOptions(rOpts, WithLogger(nil))
+	if err != nil {
+		t.Fatalf("NewRedisIDProviderWithOptions() error = %v", err)
+	}
+	return r
+}
+
+func Test_RedisIDProvider_DatabaseAndPrefix(t *testing.T) {
+	addr := redisServer(t)
+	ctx := context.Background()
+	category := "redis-options-" + strconv.FormatInt(time.Now().UnixNano(), 36)
+	r := newRedisTestProvider(t, RedisOptions{Addr: addr, DB: 2, KeyPrefix: "idgen:"})
+	if err := r.Initialize(ctx, "1-10", category); err != nil {
+		t.Fatalf("RedisIDProvider.Initialize() error = %v", err)
+	}
+	defer r.Delete(ctx, category, -1)
+
+	for _, tt := range []struct {
+		db   int
+		want bool
+	}{{db: 0, want: false}, {db: 2, want: true}} {
+		c, err := redis.Dial("tcp", addr, redis.DialDatabase(tt.db))
+		if err != nil {
+			t.Fatalf("redis.Dial() error = %v", err)
+		}
+		got, err := redis.Bool(c.Do("EXISTS", "idgen:"+category))
+		c.Close()
+		if err != nil {
+			t.Fatalf("EXISTS error = %v", err)
+		}
+		if got != tt.want {
+			t.Errorf("EXISTS idgen:%s in database %d = %v, want %v", category, tt.db, got, tt.want)
+		}
+	}
+
+	lck, err := r.Lock(ctx, category)
+	if err != nil {
+		t.Fatalf("RedisIDProvider.Lock() error = %v", err)
+	}
+	c, err := redis.Dial("tcp", addr, redis.DialDatabase(2))
+	if err != nil {
+		t.Fatalf("redis.Dial() error = %v", err)
+	}
+	locked, err := redis.Bool(c.Do("EXISTS", "idgen:lock."+category))
+	c.Close()
+	if err != nil || !locked {
+		t.Errorf("EXISTS idgen:lock.%s = %v, %v, want true", category, locked, err)
+	}
+	if err := r.Unlock(ctx, lck); err != nil {
+		t.Errorf("RedisIDProvider.Unlock() error = %v", err)
+	}
+}
+
+// Test_RedisIDProvider_Auth needs a server that requires the password in
+// REDIS_PASSWORD, and the user in REDIS_USERNAME for an ACL user.
+func Test_RedisIDProvider_Auth(t *testing.T) {
+	addr := redisServer(t)
+	password := os.Getenv("REDIS_PASSWORD")
+	if password == "" {
+		t.Skip("skipping this since REDIS_PASSWORD is not set")
+	}
+	username := os.Getenv("REDIS_USERNAME")
+	ctx := context.Background()
+
+	r := newRedisTestProvider(t, RedisOptions{Addr: addr, Username: username, Password: password})
+	if _, err := r.Exists(ctx, "uid"); err != nil {
+		t.Errorf("RedisIDProvider.Exists() error = %v", err)
+	}
+	r = newRedisTestProvider(t, RedisOptions{Addr: addr, Username: username, Password: password + "-wrong"})
+	if _, err := r.Exists(ctx, "uid"); err == nil {
+		t.Errorf("RedisIDProvider.Exists() with a wrong password error = nil")
+	}
+}
+
+func Test_RedisIDProvider_Timeout(t *testing.T) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("net.Listen() error = %v", err)
+	}
+	defer l.Close()
+	// the server accepts connections but never replies
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+	r := newRedisTestProvider(t, RedisOptions{Addr: l.Addr().String(), ReadTimeout: 100 * time.Millisecond})
+	start := time.Now()
+	_, err = r.Exists(context.Background(), "uid")
+	var netErr net.Error
+	if !errors.As(err, &netErr) || !netErr.Timeout() {
+		t.Errorf("RedisIDProvider.Exists() error = %v, want a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 2*time.Second {
+		t.Errorf("RedisIDProvider.Exists() took %v with a read timeout of 100ms", elapsed)
+	}
+}
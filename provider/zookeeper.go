@@ -1,48 +1,251 @@
 package provider
 
 import (
+	"context"
 	"errors"
+	"fmt"
 	"github.com/samuel/go-zookeeper/zk"
-	"log"
+	"github.com/zale144/id-generator/errs"
+	"github.com/zale144/id-generator/logger"
+	"strings"
+	"sync"
+	"sync/atomic"
 	"time"
 )
 
 type ZooKeeperIDProvider struct {
-	client *zk.Conn
+	client   *zk.Conn
+	basePath string
+	acl      []zk.ACL
+	logger   logger.Logger
+	// connected is 1 while a session is established.
+	connected int32
+	ready     chan struct{}
+	readyOnce sync.Once
 }
 
-func NewZooKeeperIDProvider(addr string) (*ZooKeeperIDProvider, error) {
-	c, session, err := zk.Connect([]string{addr}, time.Second)
+// ZooKeeperOptions configures a ZooKeeperIDProvider.
+type ZooKeeperOptions struct {
+	// Servers are the addresses of the ensemble's servers.
+	Servers []string
+	// SessionTimeout defaults to one second.
+	SessionTimeout time.Duration
+	// ConnectTimeout bounds the time NewZooKeeperIDProviderWithOptions waits
+	// for the first session. It defaults to ten seconds.
+	ConnectTimeout time.Duration
+	// BasePath is the znode categories and their locks are stored under, like
+	// "/id-generator". It is created along with its parents if it doesn't
+	// exist. Categories are stored at the root if it is empty.
+	BasePath string
+	// Username and Password enable digest authentication.
+	Username string
+	Password string
+	// ACL is set on every znode the provider creates. It defaults to full
+	// access for the digest user if Username is set and to full access for
+	// everyone otherwise.
+	ACL []zk.ACL
+}
+
+func (o ZooKeeperOptions) validate() error {
+	if len(o.Servers) == 0 {
+		return errors.New("at least one server is required")
+	}
+	if o.SessionTimeout < 0 {
+		return errors.New("session timeout must not be negative")
+	}
+	if o.ConnectTimeout < 0 {
+		return errors.New("connect timeout must not be negative")
+	}
+	if o.BasePath != "" && (!strings.HasPrefix(o.BasePath, "/") || strings.HasSuffix(o.BasePath, "/") || strings.Contains(o.BasePath, "//")) {
+		return errors.New("base path must start with '/', must not end with '/' and must not contain empty segments")
+	}
+	if o.Username == "" && o.Password != "" {
+		return errors.New("password is set without a username")
+	}
+	return nil
+}
+
+// acl returns the ACL set on the znodes the provider creates.
+func (o ZooKeeperOptions) acl() []zk.ACL {
+	if o.ACL != nil {
+		return o.ACL
+	}
+	if o.Username != "" {
+		return zk.DigestACL(zk.PermAll, o.Username, o.Password)
+	}
+	return zk.WorldACL(zk.PermAll)
+}
+
+func NewZooKeeperIDProvider(addr string, opts ...Option) (*ZooKeeperIDProvider, error) {
+	return NewZooKeeperIDProviderWithOptions(ZooKeeperOptions{
+		Servers: []string{addr},
+	}, opts...)
+}
+
+func NewZooKeeperIDProviderWithOptions(zkOpts ZooKeeperOptions, opts ...Option) (*ZooKeeperIDProvider, error) {
+	if err := zkOpts.validate(); err != nil {
+		return nil, fmt.Errorf("invalid ZooKeeper options: %w", err)
+	}
+	o := newOptions(opts)
+	timeout := zkOpts.SessionTimeout
+	if timeout == 0 {
+		timeout = time.Second
+	}
+	connectTimeout := zkOpts.ConnectTimeout
+	if connectTimeout == 0 {
+		connectTimeout = 10 * time.Second
+	}
+	c, session, err := zk.Connect(zkOpts.Servers, timeout, zk.WithLogger(zkLogger{o.logger}))
 	if err != nil {
 		return nil, err
 	}
+	r := &ZooKeeperIDProvider{
+		client:   c,
+		basePath: zkOpts.BasePath,
+		logger:   o.logger,
+		ready:    make(chan struct{}),
+	}
+	go r.watchSession(session)
+	select {
+	case <-r.ready:
+	case <-time.After(connectTimeout):
+		c.Close()
+		return nil, &errs.ProviderError{Op: "connect", Kind: errs.ErrDisconnected, Err: errors.New("timed out waiting for a session")}
+	}
+	if zkOpts.Username != "" {
+		if err := c.AddAuth("digest", []byte(zkOpts.Username+":"+zkOpts.Password)); err != nil {
+			c.Close()
+			return nil, zkError("auth", "", err)
+		}
+	}
+	r.acl = zkOpts.acl()
+	if err := createBasePath(c, r.basePath, r.acl); err != nil {
+		c.Close()
+		return nil, err
+	}
+	return r, nil
+}
+
+// watchSession tracks the session state until the connection is closed. The
+// client reconnects on its own, also establishing a new session after the
+// old one expired, which releases the locks held in the old session.
+func (r *ZooKeeperIDProvider) watchSession(session <-chan zk.Event) {
 	for event := range session {
-		if event.State == zk.StateConnected {
-			log.Printf("zookeeper State: %s\n", event.State)
-			break
+		if event.Type != zk.EventSession {
+			continue
+		}
+		switch event.State {
+		case zk.StateHasSession:
+			atomic.StoreInt32(&r.connected, 1)
+			r.readyOnce.Do(func() {
+				close(r.ready)
+			})
+			r.logger.Info("zookeeper session established", logger.String("server", event.Server))
+		case zk.StateExpired:
+			atomic.StoreInt32(&r.connected, 0)
+			r.logger.Warn("zookeeper session expired, locks held in it are released")
+		case zk.StateDisconnected:
+			atomic.StoreInt32(&r.connected, 0)
+			r.logger.Warn("zookeeper disconnected", logger.String("server", event.Server))
+		case zk.StateAuthFailed:
+			atomic.StoreInt32(&r.connected, 0)
+			r.logger.Error("zookeeper authentication failed")
+		default:
+			r.logger.Debug("zookeeper state changed", logger.String("state", event.State.String()))
 		}
 	}
-	return &ZooKeeperIDProvider{
-		client: c,
-	}, nil
+	atomic.StoreInt32(&r.connected, 0)
+}
+
+// Connected reports whether a session is established.
+func (r *ZooKeeperIDProvider) Connected() bool {
+	return atomic.LoadInt32(&r.connected) == 1
 }
 
-func (r *ZooKeeperIDProvider) Initialize(initSetData string, category string) error {
+// checkConnected fails fast while there is no session.
+func (r *ZooKeeperIDProvider) checkConnected(op, category string) error {
+	if !r.Connected() {
+		return &errs.ProviderError{Op: op, Category: category, Kind: errs.ErrDisconnected}
+	}
+	return nil
+}
+
+// Close closes the connection and releases the locks held by it.
+func (r *ZooKeeperIDProvider) Close() {
+	r.client.Close()
+}
+
+// znodeCreator is the part of the ZooKeeper client createBasePath uses.
+type znodeCreator interface {
+	Exists(path string) (bool, *zk.Stat, error)
+	Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error)
+}
+
+// createBasePath creates the base path and any of its missing parents.
+func createBasePath(c znodeCreator, basePath string, acl []zk.ACL) error {
+	if basePath == "" {
+		return nil
+	}
+	path := ""
+	for _, part := range strings.Split(basePath, "/")[1:] {
+		path += "/" + part
+		exists, _, err := c.Exists(path)
+		if err != nil {
+			return zkError("exists", path, err)
+		}
+		if exists {
+			continue
+		}
+		_, err = c.Create(path, nil, 0, acl)
+		if err != nil && err != zk.ErrNodeExists {
+			return zkError("create", path, err)
+		}
+	}
+	return nil
+}
+
+func (r *ZooKeeperIDProvider) path(category string) string {
+	return r.basePath + "/" + category
+}
+
+// zkLogger routes the messages of the ZooKeeper client to a logger.
+type zkLogger struct {
+	l logger.Logger
+}
+
+func (z zkLogger) Printf(format string, args ...interface{}) {
+	z.l.Info(fmt.Sprintf(format, args...))
+}
+
+func (r *ZooKeeperIDProvider) Initialize(ctx context.Context, initSetData string, category string) error {
 	if initSetData == "" {
 		return errors.New("no data provided")
 	}
-	exists, stat, err := r.client.Exists("/" + category)
-	if err != nil {
+	if err := r.checkConnected("initialize", category); err != nil {
 		return err
 	}
+	var exists bool
+	var stat *zk.Stat
+	err := withContext(ctx, func() error {
+		var err error
+		exists, stat, err = r.client.Exists(r.path(category))
+		return err
+	})
+	if err != nil {
+		return zkError("exists", category, err)
+	}
 
 	if !exists {
-		_, err = r.client.Create("/"+category, []byte(initSetData), 0, zk.WorldACL(zk.PermAll))
-		if err != nil {
+		err = withContext(ctx, func() error {
+			_, err := r.client.Create(r.path(category), []byte(initSetData), 0, r.acl)
 			return err
+		})
+		// another generator initialized the category first
+		if err != nil && err != zk.ErrNodeExists {
+			return zkError("create", category, err)
 		}
 	} else if stat.Version == 0 {
-		err = r.SetData(initSetData, category, 0)
+		err = r.SetData(ctx, initSetData, category, 0)
 		if err != nil {
 			return err
 		}
@@ -50,34 +253,114 @@ func (r *ZooKeeperIDProvider) Initialize(initSetData string, category string) er
 	return nil
 }
 
-func (r *ZooKeeperIDProvider) SetData(data, category string, version int32) error {
-	_, err := r.client.Set("/"+category, []byte(data), version)
-	if err != nil {
+func (r *ZooKeeperIDProvider) SetData(ctx context.Context, data, category string, version int32) error {
+	if err := r.checkConnected("set", category); err != nil {
 		return err
 	}
+	err := withContext(ctx, func() error {
+		_, err := r.client.Set(r.path(category), []byte(data), version)
+		return err
+	})
+	if err != nil {
+		return zkError("set", category, err)
+	}
 	return nil
 }
 
-func (r *ZooKeeperIDProvider) GetData(category string) (string, int32, error) {
-	result, stat, err := r.client.Get("/" + category)
+func (r *ZooKeeperIDProvider) GetData(ctx context.Context, category string) (string, int32, error) {
+	if err := r.checkConnected("get", category); err != nil {
+		return "", -1, err
+	}
+	type getResp struct {
+		data []byte
+		stat *zk.Stat
+	}
+	resp := make(chan getResp, 1)
+	err := withContext(ctx, func() error {
+		result, stat, err := r.client.Get(r.path(category))
+		resp <- getResp{data: result, stat: stat}
+		return err
+	})
 	if err != nil {
-		return "", -1, map[bool]error{true: err}[err != nil]
+		return "", -1, zkError("get", category, err)
 	}
-	return string(result), stat.Version, nil
+	result := <-resp
+	return string(result.data), result.stat.Version, nil
 }
 
-func (r *ZooKeeperIDProvider) Delete(category string, version int32) error {
-	err := r.client.Delete("/"+category, version)
-	if err != nil {
+func (r *ZooKeeperIDProvider) Delete(ctx context.Context, category string, version int32) error {
+	if err := r.checkConnected("delete", category); err != nil {
 		return err
 	}
+	err := withContext(ctx, func() error {
+		return r.client.Delete(r.path(category), version)
+	})
+	if err != nil {
+		return zkError("delete", category, err)
+	}
 	return nil
 }
 
-func (r *ZooKeeperIDProvider) Lock(string) (interface{}, error) {
-	return nil, nil
+// Lock acquires the category's lock using the ephemeral sequential znode
+// recipe under <BasePath>/lock.<category>. The lock is released by Unlock or, since
+// its znode is ephemeral, when the session is lost. A caller that keeps
+// working after losing its session is still stopped by the versioned Set.
+func (r *ZooKeeperIDProvider) Lock(ctx context.Context, category string) (interface{}, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, err
+	}
+	if err := r.checkConnected("lock", category); err != nil {
+		return nil, err
+	}
+	lock := zk.NewLock(r.client, r.path("lock."+category), r.acl)
+	locked := make(chan error, 1)
+	go func() {
+		locked <- lock.Lock()
+	}()
+	select {
+	case err := <-locked:
+		if err != nil {
+			return nil, zkError("lock", category, err)
+		}
+		return lock, nil
+	case <-ctx.Done():
+		// release the lock in case it is acquired after the caller gave up
+		go func() {
+			if err := <-locked; err == nil {
+				r.logger.Debug("releasing lock acquired after cancellation", logger.String("category", category))
+				if err := lock.Unlock(); err != nil {
+					r.logger.Warn("error releasing lock", logger.String("category", category), logger.Error(err))
+				}
+			}
+		}()
+		return nil, ctx.Err()
+	}
 }
 
-func (r *ZooKeeperIDProvider) Unlock(lck interface{}) error {
+func (r *ZooKeeperIDProvider) Unlock(ctx context.Context, lck interface{}) error {
+	lock, ok := lck.(*zk.Lock)
+	if !ok {
+		return &errs.ProviderError{Op: "unlock", Err: errors.New("not a ZooKeeper lock")}
+	}
+	err := withContext(ctx, lock.Unlock)
+	if err != nil {
+		return zkError("unlock", "", err)
+	}
 	return nil
 }
+
+// zkError maps an error returned by the ZooKeeper client to the errs
+// package. Context errors are returned as they are.
+func zkError(op, category string, err error) error {
+	if err == context.Canceled || err == context.DeadlineExceeded {
+		return err
+	}
+	pErr := &errs.ProviderError{Op: op, Category: category, Err: err}
+	switch err {
+	case zk.ErrBadVersion:
+		pErr.Kind = errs.ErrVersionConflict
+	case zk.ErrNoNode:
+		pErr.Kind = errs.ErrCategoryNotFound
+	}
+	return pErr
+}
@@ -0,0 +1,383 @@
+package provider
+
+import (
+	"context"
+	"errors"
+	"github.com/samuel/go-zookeeper/zk"
+	"github.com/zale144/id-generator/errs"
+	"github.com/zale144/id-generator/logger"
+	"os"
+	"reflect"
+	"sort"
+	"testing"
+	"time"
+)
+
+func Test_ZooKeeperIDProvider_watchSession(t *testing.T) {
+	r := &ZooKeeperIDProvider{
+		logger: logger.NewNop(),
+		ready:  make(chan struct{}),
+	}
+	session := make(chan zk.Event)
+	stopped := make(chan struct{})
+	go func() {
+		r.watchSession(session)
+		close(stopped)
+	}()
+	send := func(state zk.State) {
+		session <- zk.Event{Type: zk.EventSession, State: state}
+		// a second event makes sure the first one was handled
+		session <- zk.Event{Type: zk.EventNodeDataChanged}
+	}
+
+	if r.Connected() {
+		t.Errorf("ZooKeeperIDProvider.Connected() before a session = true, want false")
+	}
+	tests := []struct {
+		name          string
+		state         zk.State
+		wantConnected bool
+	}{
+		{name: "CONNECTING", state: zk.StateConnecting, wantConnected: false},
+		{name: "HAS_SESSION", state: zk.StateHasSession, wantConnected: true},
+		{name: "DISCONNECTED", state: zk.StateDisconnected, wantConnected: false},
+		{name: "RECONNECTED", state: zk.StateHasSession, wantConnected: true},
+		{name: "EXPIRED", state: zk.StateExpired, wantConnected: false},
+		{name: "NEW_SESSION", state: zk.StateHasSession, wantConnected: true},
+		{name: "AUTH_FAILED", state: zk.StateAuthFailed, wantConnected: false},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			send(tt.state)
+			if got := r.Connected(); got != tt.wantConnected {
+				t.Errorf("ZooKeeperIDProvider.Connected() = %v, want %v", got, tt.wantConnected)
+			}
+			// calls fail fast without a session, before using the client
+			if !tt.wantConnected {
+				if _, _, err := r.GetData(context.Background(), "uid"); !errors.Is(err, errs.ErrDisconnected) {
+					t.Errorf("ZooKeeperIDProvider.GetData() error = %v, want %v", err, errs.ErrDisconnected)
+				}
+				if _, err := r.Lock(context.Background(), "uid"); !errors.Is(err, errs.ErrDisconnected) {
+					t.Errorf("ZooKeeperIDProvider.Lock() error = %v, want %v", err, errs.ErrDisconnected)
+				}
+			}
+		})
+	}
+	select {
+	case <-r.ready:
+	default:
+		t.Errorf("ZooKeeperIDProvider.ready not closed after the first session")
+	}
+
+	send(zk.StateHasSession)
+	close(session)
+	select {
+	case <-stopped:
+	case <-time.After(time.Second):
+		t.Errorf("ZooKeeperIDProvider.watchSession() didn't return after the connection was closed")
+		return
+	}
+	if r.Connected() {
+		t.Errorf("ZooKeeperIDProvider.Connected() after close = true, want false")
+	}
+}
+
+// zkServer returns the address of the ZooKeeper server the integration tests
+// run against, taken from ZOOKEEPER_ADDR.
+func zkServer(t *testing.T) string {
+	t.Helper()
+	if testing.Short() {
+		t.Skip("skipping this since ZooKeeper is not being used yet")
+	}
+	if addr := os.Getenv("ZOOKEEPER_ADDR"); addr != "" {
+		return addr
+	}
+	return "localhost:2181"
+}
+
+func newZooKeeperTestProvider(t *testing.T, zkOpts ZooKeeperOptions) *ZooKeeperIDProvider {
+	t.Helper()
+	r, err := NewZooKeeperIDProviderWithOptions(zkOpts, WithLogger(nil))
+	if err != nil {
+		t.Fatalf("NewZooKeeperIDProviderWithOptions() error = %v", err)
+	}
+	return r
+}
+
+func Test_ZooKeeperIDProvider_LockCanceled(t *testing.T) {
+	r := &ZooKeeperIDProvider{logger: logger.NewNop()}
+	ctx, cancel := context.WithCancel(context.Background())
+	cancel()
+	if _, err := r.Lock(ctx, "uid"); err != context.Canceled {
+		t.Errorf("ZooKeeperIDProvider.Lock() error = %v, want %v", err, context.Canceled)
+	}
+}
+
+func Test_ZooKeeperIDProvider_Lock(t *testing.T) {
+	addr := zkServer(t)
+	const category = "zk_lock_uid"
+	zkOpts := ZooKeeperOptions{Servers: []string{addr}, BasePath: "/id-generator-test"}
+	holder := newZooKeeperTestProvider(t, zkOpts)
+	defer holder.Close()
+	waiter := newZooKeeperTestProvider(t, zkOpts)
+	defer waiter.Close()
+	ctx := context.Background()
+
+	// the lock excludes other sessions until it is released
+	lock, err := holder.Lock(ctx, category)
+	if err != nil {
+		t.Errorf("ZooKeeperIDProvider.Lock() error = %v", err)
+		return
+	}
+	timeout, cancel := context.WithTimeout(ctx, 200*time.Millisecond)
+	defer cancel()
+	if _, err := waiter.Lock(timeout, category); err != context.DeadlineExceeded {
+		t.Errorf("ZooKeeperIDProvider.Lock() of a held lock error = %v, want %v", err, context.DeadlineExceeded)
+	}
+
+	// the waiter gave up, so the lock it acquires once the holder releases
+	// the lock is released again in the background
+	if err := holder.Unlock(ctx, lock); err != nil {
+		t.Errorf("ZooKeeperIDProvider.Unlock() error = %v", err)
+		return
+	}
+	timeout, cancel = context.WithTimeout(ctx, 5*time.Second)
+	defer cancel()
+	lock, err = holder.Lock(timeout, category)
+	if err != nil {
+		t.Errorf("ZooKeeperIDProvider.Lock() after the canceled waiter error = %v", err)
+		return
+	}
+	if err := holder.Unlock(ctx, lock); err != nil {
+		t.Errorf("ZooKeeperIDProvider.Unlock() error = %v", err)
+	}
+	if err := holder.Unlock(ctx, "not a lock"); err == nil {
+		t.Errorf("ZooKeeperIDProvider.Unlock() of a foreign lock error = nil, want an error")
+	}
+}
+
+func Test_ZooKeeperIDProvider_LockSessionLoss(t *testing.T) {
+	addr := zkServer(t)
+	const category = "zk_lock_session_uid"
+	zkOpts := ZooKeeperOptions{Servers: []string{addr}, BasePath: "/id-generator-test"}
+	holder := newZooKeeperTestProvider(t, zkOpts)
+	waiter := newZooKeeperTestProvider(t, zkOpts)
+	defer waiter.Close()
+	ctx := context.Background()
+
+	if _, err := holder.Lock(ctx, category); err != nil {
+		t.Errorf("ZooKeeperIDProvider.Lock() error = %v", err)
+		holder.Close()
+		return
+	}
+	locked := make(chan error, 1)
+	go func() {
+		timeout, cancel := context.WithTimeout(ctx, 10*time.Second)
+		defer cancel()
+		lock, err := waiter.Lock(timeout, category)
+		if err == nil {
+			err = waiter.Unlock(ctx, lock)
+		}
+		locked <- err
+	}()
+
+	// the lock's znode is ephemeral, so ending the holder's session without
+	// unlocking releases it
+	holder.Close()
+	if err := <-locked; err != nil {
+		t.Errorf("ZooKeeperIDProvider.Lock() after the holder's session ended error = %v", err)
+	}
+}
+
+func Test_ZooKeeperOptions_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		zkOpts  ZooKeeperOptions
+		wantErr bool
+	}{
+		{name: "VALID", zkOpts: ZooKeeperOptions{Servers: []string{"a:2181", "b:2181"}, BasePath: "/a/b", Username: "u", Password: "p"}},
+		{name: "NO_SERVERS", zkOpts: ZooKeeperOptions{}, wantErr: true},
+		{name: "NEGATIVE_SESSION_TIMEOUT", zkOpts: ZooKeeperOptions{Servers: []string{"a:2181"}, SessionTimeout: -1}, wantErr: true},
+		{name: "NEGATIVE_CONNECT_TIMEOUT", zkOpts: ZooKeeperOptions{Servers: []string{"a:2181"}, ConnectTimeout: -1}, wantErr: true},
+		{name: "RELATIVE_BASE_PATH", zkOpts: ZooKeeperOptions{Servers: []string{"a:2181"}, BasePath: "a"}, wantErr: true},
+		{name: "TRAILING_SLASH", zkOpts: ZooKeeperOptions{Servers: []string{"a:2181"}, BasePath: "/a/"}, wantErr: true},
+		{name: "EMPTY_SEGMENT", zkOpts: ZooKeeperOptions{Servers: []string{"a:2181"}, BasePath: "/a//b"}, wantErr: true},
+		{name: "PASSWORD_WITHOUT_USERNAME", zkOpts: ZooKeeperOptions{Servers: []string{"a:2181"}, Password: "p"}, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.zkOpts.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("ZooKeeperOptions.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_ZooKeeperOptions_acl(t *testing.T) {
+	custom := zk.WorldACL(zk.PermRead)
+	tests := []struct {
+		name   string
+		zkOpts ZooKeeperOptions
+		want   []zk.ACL
+	}{
+		{name: "DEFAULT", zkOpts: ZooKeeperOptions{}, want: zk.WorldACL(zk.PermAll)},
+		{name: "DIGEST", zkOpts: ZooKeeperOptions{Username: "u", Password: "p"}, want: zk.DigestACL(zk.PermAll, "u", "p")},
+		{name: "CUSTOM", zkOpts: ZooKeeperOptions{Username: "u", Password: "p", ACL: custom}, want: custom},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := tt.zkOpts.acl(); !reflect.DeepEqual(got, tt.want) {
+				t.Errorf("ZooKeeperOptions.acl() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ZooKeeperIDProvider_path(t *testing.T) {
+	tests := []struct {
+		basePath string
+		want     string
+	}{
+		{basePath: "", want: "/uid"},
+		{basePath: "/id-generator", want: "/id-generator/uid"},
+		{basePath: "/a/b", want: "/a/b/uid"},
+	}
+	for _, tt := range tests {
+		r := &ZooKeeperIDProvider{basePath: tt.basePath}
+		if got := r.path("uid"); got != tt.want {
+			t.Errorf("ZooKeeperIDProvider.path() with base path '%s' = %v, want %v", tt.basePath, got, tt.want)
+		}
+	}
+}
+
+// fakeZnodes records the znodes created through it. Creating a znode in
+// racing fails with ErrNodeExists as if another client created it first.
+type fakeZnodes struct {
+	nodes   map[string][]zk.ACL
+	racing  string
+	failing error
+}
+
+func (f *fakeZnodes) Exists(path string) (bool, *zk.Stat, error) {
+	if f.failing != nil {
+		return false, nil, f.failing
+	}
+	_, ok := f.nodes[path]
+	return ok, nil, nil
+}
+
+func (f *fakeZnodes) Create(path string, data []byte, flags int32, acl []zk.ACL) (string, error) {
+	if _, ok := f.nodes[path]; ok || path == f.racing {
+		return "", zk.ErrNodeExists
+	}
+	f.nodes[path] = acl
+	return path, nil
+}
+
+func Test_createBasePath(t *testing.T) {
+	acl := zk.DigestACL(zk.PermAll, "u", "p")
+	tests := []struct {
+		name     string
+		basePath string
+		existing []string
+		racing   string
+		failing  error
+		want     []string
+		wantErr  bool
+	}{
+		{name: "ROOT", basePath: "", want: nil},
+		{name: "NEW", basePath: "/a/b/c", want: []string{"/a", "/a/b", "/a/b/c"}},
+		{name: "PARENT_EXISTS", basePath: "/a/b", existing: []string{"/a"}, want: []string{"/a/b"}},
+		{name: "ALL_EXIST", basePath: "/a/b", existing: []string{"/a", "/a/b"}, want: nil},
+		{name: "CREATED_CONCURRENTLY", basePath: "/a/b", racing: "/a", want: []string{"/a/b"}},
+		{name: "EXISTS_FAILS", basePath: "/a", failing: zk.ErrNoAuth, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			f := &fakeZnodes{nodes: make(map[string][]zk.ACL), racing: tt.racing, failing: tt.failing}
+			for _, path := range tt.existing {
+				f.nodes[path] = zk.WorldACL(zk.PermAll)
+			}
+			err := createBasePath(f, tt.basePath, acl)
+			if (err != nil) != tt.wantErr {
+				t.Errorf("createBasePath() error = %v, wantErr %v", err, tt.wantErr)
+				return
+			}
+			var created []string
+			for path, nodeACL := range f.nodes {
+				if !reflect.DeepEqual(nodeACL, acl) {
+					continue
+				}
+				created = append(created, path)
+			}
+			sort.Strings(created)
+			if !reflect.DeepEqual(created, tt.want) {
+				t.Errorf("createBasePath() created = %v, want %v", created, tt.want)
+			}
+		})
+	}
+}
+
+func Test_ZooKeeperIDProvider_Ensemble(t *testing.T) {
+	addr := zkServer(t)
+	// the client moves on to the next server if one can't be reached
+	r := newZooKeeperTestProvider(t, ZooKeeperOptions{
+		Servers:        []string{"127.0.0.1:1", addr},
+		SessionTimeout: 2 * time.Second,
+		BasePath:       "/id-generator-test/ensemble",
+	})
+	defer r.Close()
+	if !r.Connected() {
+		t.Errorf("ZooKeeperIDProvider.Connected() = false, want true")
+	}
+	exists, _, err := r.client.Exists("/id-generator-test/ensemble")
+	if err != nil || !exists {
+		t.Errorf("base path exists = %v, %v, want true", exists, err)
+	}
+}
+
+func Test_ZooKeeperIDProvider_DigestAuth(t *testing.T) {
+	addr := zkServer(t)
+	const category = "zk_auth_uid"
+	const basePath = "/id-generator-test-auth"
+	ctx := context.Background()
+
+	owner := newZooKeeperTestProvider(t, ZooKeeperOptions{
+		Servers:  []string{addr},
+		BasePath: basePath,
+		Username: "generator",
+		Password: "secret",
+	})
+	defer owner.Close()
+	owner.Delete(ctx, category, -1)
+	defer owner.Delete(ctx, category, -1)
+	if err := owner.Initialize(ctx, "data", category); err != nil {
+		t.Errorf("ZooKeeperIDProvider.Initialize() error = %v", err)
+		return
+	}
+	data, _, err := owner.GetData(ctx, category)
+	if err != nil || data != "data" {
+		t.Errorf("ZooKeeperIDProvider.GetData() = %v, %v, want %v", data, err, "data")
+	}
+	acl, _, err := owner.client.GetACL(owner.path(category))
+	if err != nil {
+		t.Errorf("Conn.GetACL() error = %v", err)
+		return
+	}
+	if want := zk.DigestACL(zk.PermAll, "generator", "secret"); !reflect.DeepEqual(acl, want) {
+		t.Errorf("Conn.GetACL() = %v, want %v", acl, want)
+	}
+
+	// the znodes are only accessible with the digest credentials
+	for _, zkOpts := range []ZooKeeperOptions{
+		{Servers: []string{addr}},
+		{Servers: []string{addr}, Username: "generator", Password: "wrong"},
+	} {
+		other := newZooKeeperTestProvider(t, zkOpts)
+		_, _, err := other.GetData(ctx, basePath[1:]+"/"+category)
+		other.Close()
+		if !errors.Is(err, zk.ErrNoAuth) {
+			t.Errorf("ZooKeeperIDProvider.GetData() as user '%s' error = %v, want %v", zkOpts.Username, err, zk.ErrNoAuth)
+		}
+	}
+}
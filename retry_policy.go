@@ -0,0 +1,107 @@
+package id_generator
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"math/rand"
+	"time"
+)
+
+// RetryPolicy controls how often and how fast an update of a category's state
+// is retried after a version conflict. Any other error fails the update
+// right away.
+type RetryPolicy struct {
+	// MaxAttempts is the maximum number of attempts, including the first one.
+	MaxAttempts int
+	// InitialBackoff is the delay before the first retry. Every further retry
+	// waits Multiplier times longer, up to MaxBackoff.
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	Multiplier     float64
+	// Jitter randomly shortens every delay by up to this fraction of it, so
+	// generators that conflicted with each other don't retry in lockstep.
+	Jitter float64
+	// MaxElapsed bounds the total time spent retrying. Zero means no limit.
+	MaxElapsed time.Duration
+}
+
+// DefaultRetryPolicy is used by generators without a retry policy set.
+var DefaultRetryPolicy = RetryPolicy{
+	MaxAttempts:    maxTryCount,
+	InitialBackoff: time.Millisecond,
+	MaxBackoff:     50 * time.Millisecond,
+	Multiplier:     2,
+	Jitter:         0.5,
+}
+
+func (p RetryPolicy) validate() error {
+	if p.MaxAttempts <= 0 {
+		return errors.New("max attempts must be greater than 0")
+	}
+	if p.InitialBackoff < 0 {
+		return errors.New("initial backoff must not be negative")
+	}
+	if p.MaxBackoff < p.InitialBackoff {
+		return errors.New("max backoff must not be less than initial backoff")
+	}
+	if p.Multiplier < 1 {
+		return errors.New("multiplier must not be less than 1")
+	}
+	if p.Jitter < 0 || p.Jitter > 1 {
+		return errors.New("jitter must be between 0 and 1")
+	}
+	if p.MaxElapsed < 0 {
+		return errors.New("max elapsed time must not be negative")
+	}
+	return nil
+}
+
+// backoff returns the delay before the retry following the given attempt,
+// counting from 1.
+func (p RetryPolicy) backoff(attempt int) time.Duration {
+	delay := float64(p.InitialBackoff)
+	for i := 1; i < attempt && delay < float64(p.MaxBackoff); i++ {
+		delay *= p.Multiplier
+	}
+	if delay > float64(p.MaxBackoff) {
+		delay = float64(p.MaxBackoff)
+	}
+	if p.Jitter > 0 {
+		delay -= delay * p.Jitter * rand.Float64()
+	}
+	return time.Duration(delay)
+}
+
+// SetRetryPolicy sets how updates of a category's state are retried after a
+// version conflict. Generators use DefaultRetryPolicy until it is set.
+func (g *IDGenerator) SetRetryPolicy(policy RetryPolicy) error {
+	if err := policy.validate(); err != nil {
+		return errors.New(fmt.Sprintf("invalid retry policy: %s", err))
+	}
+	g.catMu.Lock()
+	g.retries = policy
+	g.catMu.Unlock()
+	return nil
+}
+
+func (g *IDGenerator) retryPolicy() RetryPolicy {
+	g.catMu.Lock()
+	defer g.catMu.Unlock()
+	return g.retries
+}
+
+// sleep waits for d or until ctx is done.
+func sleep(ctx context.Context, d time.Duration) error {
+	if d <= 0 {
+		return ctx.Err()
+	}
+	timer := time.NewTimer(d)
+	defer timer.Stop()
+	select {
+	case <-timer.C:
+		return nil
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
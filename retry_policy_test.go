@@ -0,0 +1,105 @@
+package id_generator
+
+import (
+	"testing"
+	"time"
+)
+
+func Test_retryPolicy_validate(t *testing.T) {
+	tests := []struct {
+		name    string
+		policy  RetryPolicy
+		wantErr bool
+	}{
+		{
+			name:   "DEFAULT",
+			policy: DefaultRetryPolicy,
+		},
+		{
+			name:   "NO_BACKOFF",
+			policy: RetryPolicy{MaxAttempts: 1, Multiplier: 1},
+		},
+		{
+			name:    "ZERO_ATTEMPTS",
+			policy:  RetryPolicy{Multiplier: 1},
+			wantErr: true,
+		},
+		{
+			name: "MAX_LESS_THAN_INITIAL",
+			policy: RetryPolicy{
+				MaxAttempts:    3,
+				InitialBackoff: time.Second,
+				MaxBackoff:     time.Millisecond,
+				Multiplier:     2,
+			},
+			wantErr: true,
+		},
+		{
+			name:    "MULTIPLIER_LESS_THAN_ONE",
+			policy:  RetryPolicy{MaxAttempts: 3, Multiplier: 0.5},
+			wantErr: true,
+		},
+		{
+			name:    "JITTER_TOO_HIGH",
+			policy:  RetryPolicy{MaxAttempts: 3, Multiplier: 1, Jitter: 1.5},
+			wantErr: true,
+		},
+		{
+			name:    "NEGATIVE_MAX_ELAPSED",
+			policy:  RetryPolicy{MaxAttempts: 3, Multiplier: 1, MaxElapsed: -time.Second},
+			wantErr: true,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if err := tt.policy.validate(); (err != nil) != tt.wantErr {
+				t.Errorf("RetryPolicy.validate() error = %v, wantErr %v", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+func Test_retryPolicy_backoff(t *testing.T) {
+	policy := RetryPolicy{
+		MaxAttempts:    10,
+		InitialBackoff: 10 * time.Millisecond,
+		MaxBackoff:     50 * time.Millisecond,
+		Multiplier:     2,
+	}
+	tests := []struct {
+		name    string
+		attempt int
+		want    time.Duration
+	}{
+		{
+			name:    "FIRST",
+			attempt: 1,
+			want:    10 * time.Millisecond,
+		},
+		{
+			name:    "THIRD",
+			attempt: 3,
+			want:    40 * time.Millisecond,
+		},
+		{
+			name:    "CAPPED",
+			attempt: 9,
+			want:    50 * time.Millisecond,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := policy.backoff(tt.attempt); got != tt.want {
+				t.Errorf("RetryPolicy.backoff() = %v, want %v", got, tt.want)
+			}
+		})
+	}
+
+	policy.Jitter = 0.5
+	for i := 0; i < 100; i++ {
+		got := policy.backoff(1)
+		if got < 5*time.Millisecond || got > 10*time.Millisecond {
+			t.Errorf("RetryPolicy.backoff() with jitter = %v, want between %v and %v", got, 5*time.Millisecond, 10*time.Millisecond)
+		}
+	}
+}